@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// customHeaders are the -header-all-hosts values,
+	// sent with every request
+	customHeaders = http.Header{}
+	// credentialHeaders are the -header values and credentials,
+	// sent only to credentialHosts
+	credentialHeaders = http.Header{}
+	// credentialHosts are hosts of the start pages
+	credentialHosts = map[string]bool{}
+	// machines are the parsed -netrc entries
+	machines []netrcMachine
+)
+
+// netrcMachine is a single netrc entry,
+// an empty name is the default entry
+type netrcMachine struct {
+	name, login, password string
+}
+
+// parseHeader parses a "Name: value" header
+func parseHeader(h string) (string, string, error) {
+	parts := strings.SplitN(h, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return "", "", fmt.Errorf("invalid header %q, expected `Name: value`", h)
+	}
+
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), nil
+}
+
+// isCredentialHeader checks whether header carries credentials,
+// those are left out of archived requests
+func isCredentialHeader(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case "Authorization", "Cookie", "Proxy-Authorization":
+		return true
+	}
+
+	return false
+}
+
+// parseAuthOptions builds the request headers from -header,
+// -header-all-hosts, -basic-auth, -bearer-token-file and -netrc
+func parseAuthOptions() error {
+	// API keys and the like aren't for third-party hosts
+	for _, h := range extraHeaders {
+		name, value, err := parseHeader(h)
+		if err != nil {
+			return err
+		}
+
+		credentialHeaders.Add(name, value)
+	}
+
+	for _, h := range allHostsHeaders {
+		name, value, err := parseHeader(h)
+		if err != nil {
+			return err
+		}
+
+		customHeaders.Add(name, value)
+	}
+
+	if *basicAuth != "" {
+		parts := strings.SplitN(*basicAuth, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid -basic-auth, expected user:pass")
+		}
+
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(parts[0], parts[1])
+		credentialHeaders.Set("Authorization", req.Header.Get("Authorization"))
+	}
+
+	if *bearerTokenFile != "" {
+		data, err := ioutil.ReadFile(*bearerTokenFile)
+		if err != nil {
+			return err
+		}
+
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return fmt.Errorf("empty bearer token in %s", *bearerTokenFile)
+		}
+
+		credentialHeaders.Set("Authorization", "Bearer "+token)
+	}
+
+	if *netrcFile != "" {
+		data, err := ioutil.ReadFile(expandHome(*netrcFile))
+		if err != nil {
+			return err
+		}
+
+		machines = parseNetrc(data)
+	}
+
+	return nil
+}
+
+// scopeCredentials allows credentials to be sent
+// to the hosts of the start pages only
+func scopeCredentials(pages []string) {
+	for _, p := range pages {
+		parsed, err := url.Parse(p)
+		if err != nil {
+			continue
+		}
+
+		credentialHosts[strings.ToLower(parsed.Host)] = true
+	}
+}
+
+// setHeaders sets custom headers on req, and credentials
+// when the request goes to one of the start pages hosts
+func setHeaders(req *http.Request) {
+	for name, values := range customHeaders {
+		req.Header[name] = append([]string(nil), values...)
+	}
+
+	// configured for this very host, credentials included
+	if hc := hostOverride(req.URL); hc != nil {
+		for name, values := range hc.headers {
+			req.Header[name] = append([]string(nil), values...)
+		}
+	}
+
+	if !credentialHosts[strings.ToLower(req.URL.Host)] {
+		return
+	}
+
+	for name, values := range credentialHeaders {
+		req.Header[name] = append([]string(nil), values...)
+	}
+
+	if req.Header.Get("Authorization") != "" {
+		return
+	}
+
+	if m := findMachine(machines, req.URL.Hostname()); m != nil {
+		req.SetBasicAuth(m.login, m.password)
+	}
+}
+
+// maxRedirects is the redirect limit of net/http
+const maxRedirects = 10
+
+// scopeRedirect sets the headers of req again for the host it's
+// redirected to, net/http copies those of the first request,
+// credentials and -header values included
+func scopeRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+
+	for name := range credentialHeaders {
+		req.Header.Del(name)
+	}
+	req.Header.Del("Authorization")
+
+	for _, r := range via {
+		if hc := hostOverride(r.URL); hc != nil {
+			for name := range hc.headers {
+				req.Header.Del(name)
+			}
+		}
+	}
+
+	setHeaders(req)
+
+	return nil
+}
+
+// findMachine finds the netrc entry of host,
+// falling back to the default entry
+func findMachine(machines []netrcMachine, host string) *netrcMachine {
+	var fallback *netrcMachine
+
+	for i, m := range machines {
+		if m.name == "" {
+			if fallback == nil {
+				fallback = &machines[i]
+			}
+			continue
+		}
+
+		if strings.EqualFold(m.name, host) {
+			return &machines[i]
+		}
+	}
+
+	return fallback
+}
+
+// parseNetrc parses netrc data, macdef and account are ignored
+func parseNetrc(data []byte) []netrcMachine {
+	var (
+		machines []netrcMachine
+		current  *netrcMachine
+	)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Split(bufio.ScanWords)
+
+	for scanner.Scan() {
+		word := scanner.Text()
+
+		switch word {
+		case "machine":
+			if !scanner.Scan() {
+				break
+			}
+			machines = append(machines, netrcMachine{name: scanner.Text()})
+			current = &machines[len(machines)-1]
+		case "default":
+			machines = append(machines, netrcMachine{})
+			current = &machines[len(machines)-1]
+		case "login", "password", "account":
+			if !scanner.Scan() || current == nil {
+				continue
+			}
+
+			switch word {
+			case "login":
+				current.login = scanner.Text()
+			case "password":
+				current.password = scanner.Text()
+			}
+		}
+	}
+
+	return machines
+}
+
+// expandHome expands a leading ~/ to the user home directory
+func expandHome(p string) string {
+	if !strings.HasPrefix(p, "~/") {
+		return p
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+
+	return filepath.Join(home, p[2:])
+}
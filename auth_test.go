@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParseNetrc(t *testing.T) {
+	const data = `
+machine docs.example.com
+	login alice
+	password s3cret
+default login anonymous password guest
+`
+	machines := parseNetrc([]byte(data))
+
+	if len(machines) != 2 {
+		t.Error("Wrong parsed machines count", len(machines))
+		return
+	}
+
+	m := findMachine(machines, "DOCS.example.com")
+	if m == nil || m.login != "alice" || m.password != "s3cret" {
+		t.Error("Wrong machine for docs.example.com", m)
+	}
+
+	m = findMachine(machines, "cdn.example.net")
+	if m == nil || m.login != "anonymous" {
+		t.Error("Expected the default machine, But Got:", m)
+	}
+
+}
+
+func TestSetHeaders(t *testing.T) {
+	defer func() {
+		customHeaders = http.Header{}
+		credentialHeaders = http.Header{}
+		credentialHosts = map[string]bool{}
+	}()
+
+	customHeaders.Set("Accept-Language", "en")
+	credentialHeaders.Set("Authorization", "Bearer token")
+	scopeCredentials([]string{"https://docs.example.com/start"})
+
+	req, _ := http.NewRequest("GET", "https://docs.example.com/page", nil)
+	setHeaders(req)
+
+	if req.Header.Get("Authorization") != "Bearer token" {
+		t.Error("Credentials not sent to the start pages host")
+	}
+
+	if req.Header.Get("Accept-Language") != "en" {
+		t.Error("Custom header not sent")
+	}
+
+	req, _ = http.NewRequest("GET", "https://cdn.example.net/lib.js", nil)
+	setHeaders(req)
+
+	if req.Header.Get("Authorization") != "" {
+		t.Error("Credentials sent to a third-party host")
+	}
+
+	if req.Header.Get("Accept-Language") != "en" {
+		t.Error("Custom header not sent to a third-party host")
+	}
+
+}
+
+func TestParseAuthOptionsScopesHeaders(t *testing.T) {
+	savedExtra, savedAll := extraHeaders, allHostsHeaders
+	defer func() {
+		extraHeaders, allHostsHeaders = savedExtra, savedAll
+		customHeaders = http.Header{}
+		credentialHeaders = http.Header{}
+		credentialHosts = map[string]bool{}
+	}()
+
+	extraHeaders = listFlag{"X-Api-Key: secret", "PRIVATE-TOKEN: token"}
+	allHostsHeaders = listFlag{"Accept-Language: fr"}
+
+	if err := parseAuthOptions(); err != nil {
+		t.Fatal(err)
+	}
+
+	scopeCredentials([]string{"https://gitlab.example.com/"})
+
+	req, _ := http.NewRequest("GET", "https://gitlab.example.com/api", nil)
+	setHeaders(req)
+
+	if req.Header.Get("X-Api-Key") != "secret" || req.Header.Get("Private-Token") != "token" {
+		t.Error("Expected: -header sent to the start pages host", "But Got:", req.Header)
+	}
+
+	req, _ = http.NewRequest("GET", "https://cdn.example.net/lib.js", nil)
+	setHeaders(req)
+
+	if req.Header.Get("X-Api-Key") != "" || req.Header.Get("Private-Token") != "" {
+		t.Error("Expected: -header not sent to a third-party host", "But Got:", req.Header)
+	}
+
+	if req.Header.Get("Accept-Language") != "fr" {
+		t.Error("Expected: -header-all-hosts sent to every host", "But Got:", req.Header)
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	name, value, err := parseHeader("X-Token:  a:b ")
+	if err != nil || name != "X-Token" || value != "a:b" {
+		t.Error("Wrong parsed header", name, value, err)
+	}
+
+	for _, h := range []string{"X-Token", ": value"} {
+		if _, _, err := parseHeader(h); err == nil {
+			t.Error(h, "is invalid, but got no err")
+		}
+	}
+
+}
+
+func TestScopeRedirect(t *testing.T) {
+	var leaked http.Header
+
+	third := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		leaked = r.Header.Clone()
+		w.Write([]byte("ok"))
+	}))
+	defer third.Close()
+
+	start := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "secret" {
+			t.Error("Expected: X-Api-Key sent to the start page host", "But Got:", r.Header)
+		}
+
+		http.Redirect(w, r, third.URL+"/elsewhere", http.StatusFound)
+	}))
+	defer start.Close()
+
+	parsed, _ := url.Parse(start.URL)
+
+	defer func() {
+		customHeaders = http.Header{}
+		credentialHeaders = http.Header{}
+		credentialHosts = map[string]bool{}
+		hostConfigs = map[string]*hostConfig{}
+	}()
+
+	customHeaders.Set("Accept-Language", "en")
+	credentialHeaders.Set("X-Api-Key", "secret")
+	credentialHeaders.Set("Authorization", "Bearer token")
+	scopeCredentials([]string{start.URL + "/"})
+
+	// headers of -config for the start page host only
+	hostConfigs = map[string]*hostConfig{
+		parsed.Host: {headers: http.Header{"X-Team": {"docs"}}},
+	}
+
+	resp, err := fetchNow(start.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if leaked == nil {
+		t.Fatal("Expected: the redirect followed", "But Got: nothing")
+	}
+
+	for _, name := range []string{"X-Api-Key", "Authorization", "X-Team"} {
+		if leaked.Get(name) != "" {
+			t.Error("Expected:", name, "not sent to the third-party host", "But Got:", leaked.Get(name))
+		}
+	}
+
+	if leaked.Get("Accept-Language") != "en" {
+		t.Error("Expected: -header-all-hosts sent to every host", "But Got:", leaked)
+	}
+}
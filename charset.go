@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/unicode"
+)
+
+const (
+	// acceptEncoding is sent unless set with -header,
+	// bodies are decoded by decodeBody
+	acceptEncoding = "gzip, deflate, br"
+	utf8Name       = "utf-8"
+)
+
+// decodedBody reads the decompressed body
+// and closes the decompressors with the original body
+type decodedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+// Close closes the decompressors then the original body
+func (b *decodedBody) Close() error {
+	var err error
+
+	for i := len(b.closers) - 1; i >= 0; i-- {
+		if e := b.closers[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// decodeBody replaces the response body with a reader that undoes
+// Content-Encoding, so what we store is the resource itself
+func decodeBody(resp *http.Response) error {
+	header := resp.Header.Get("Content-Encoding")
+	if header == "" {
+		return nil
+	}
+
+	body := &decodedBody{
+		Reader:  resp.Body,
+		closers: []io.Closer{resp.Body},
+	}
+
+	codings := strings.Split(header, ",")
+
+	// codings are listed in the order they were applied
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.ToLower(strings.TrimSpace(codings[i]))
+
+		switch coding {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			r, err := gzip.NewReader(body.Reader)
+			if err != nil {
+				return fmt.Errorf("gzip -> %v", err)
+			}
+			body.Reader = r
+			body.closers = append(body.closers, r)
+		case "deflate":
+			r, err := newDeflateReader(body.Reader)
+			if err != nil {
+				return fmt.Errorf("deflate -> %v", err)
+			}
+			body.Reader = r
+			body.closers = append(body.closers, r)
+		case "br":
+			body.Reader = brotli.NewReader(body.Reader)
+		default:
+			return fmt.Errorf("unsupported Content-Encoding %q", coding)
+		}
+	}
+
+	resp.Body = body
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+
+	return nil
+}
+
+// newDeflateReader reads "deflate" bodies, which should be
+// zlib wrapped, but some servers send raw deflate data
+func newDeflateReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+
+	header, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+
+	// zlib: deflate method and a valid header checksum
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+
+	return flate.NewReader(br), nil
+}
+
+// isText checks whether the media type is HTML, CSS or JS,
+// those are decoded to UTF-8 for processing
+func isText(mt string) bool {
+	switch mt {
+	case "text/html", "application/xhtml+xml", "text/css",
+		"text/javascript", "application/javascript",
+		"application/x-javascript", "application/ecmascript",
+		"text/ecmascript":
+		return true
+	}
+
+	return false
+}
+
+// decodeText detects the charset of data from the BOM, the Content-Type
+// value, <meta charset> or sniffing, and converts it to UTF-8
+func decodeText(data []byte, contentType string) (string, encoding.Encoding, string) {
+	enc, name, certain := charset.DetermineEncoding(data, contentType)
+
+	// sniffing defaults to windows-1252,
+	// but plain ASCII or valid UTF-8 is more likely UTF-8
+	if !certain && name != utf8Name && utf8.Valid(data) {
+		enc, name = encoding.Nop, utf8Name
+	}
+
+	if name == utf8Name {
+		return strings.TrimPrefix(string(data), "\ufeff"), unicode.UTF8, name
+	}
+
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		// keep going with what we have
+		return string(data), encoding.Nop, name
+	}
+
+	return strings.TrimPrefix(string(decoded), "\ufeff"), enc, name
+}
+
+// normalizeText converts fetched HTML, CSS or JS to UTF-8,
+// or back to its original charset with -keep-charset,
+// making <meta charset> or @charset consistent with it.
+// It returns the data and its new Content-Type value
+func normalizeText(data []byte, contentType string) ([]byte, string, error) {
+	mt := parseMediaType(contentType)
+
+	s, enc, name := decodeText(data, contentType)
+
+	if !*keepCharset || name == utf8Name {
+		enc, name = unicode.UTF8, utf8Name
+	}
+
+	switch mt {
+	case "text/css":
+		s = setCSSCharset(s, name)
+	case "text/html", "application/xhtml+xml":
+		s = setMetaCharset(s, name)
+	}
+
+	contentType = mime.FormatMediaType(mt, map[string]string{
+		"charset": name,
+	})
+
+	if name == utf8Name {
+		return []byte(s), contentType, nil
+	}
+
+	encoder := encoding.ReplaceUnsupported(enc.NewEncoder())
+	if mt == "text/html" || mt == "application/xhtml+xml" {
+		encoder = encoding.HTMLEscapeUnsupported(enc.NewEncoder())
+	}
+
+	encoded, err := encoder.Bytes([]byte(s))
+	if err != nil {
+		return nil, "", fmt.Errorf("encoding to %s -> %v", name, err)
+	}
+
+	return encoded, contentType, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"golang.org/x/text/encoding/charmap"
+)
+
+func TestDecodeBody(t *testing.T) {
+	const content = `<html><body>Hello</body></html>`
+
+	encoders := map[string]func(io.Writer) io.WriteCloser{
+		"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"deflate": func(w io.Writer) io.WriteCloser {
+			return zlib.NewWriter(w)
+		},
+		"br": func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) },
+	}
+
+	// raw deflate, sent by some servers as "deflate"
+	encoders[" Deflate "] = func(w io.Writer) io.WriteCloser {
+		fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+		return fw
+	}
+
+	for coding, newEncoder := range encoders {
+		buff := &bytes.Buffer{}
+		w := newEncoder(buff)
+		w.Write([]byte(content))
+		w.Close()
+
+		resp := &http.Response{
+			Header: http.Header{},
+			Body:   ioutil.NopCloser(buff),
+		}
+		resp.Header.Set("Content-Encoding", coding)
+
+		if err := decodeBody(resp); err != nil {
+			t.Error(coding, "decodeBody() ->", err)
+			continue
+		}
+
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil || string(data) != content {
+			t.Error(coding, "Expected:", content, "But Got:", string(data), err)
+		}
+
+		if resp.Header.Get("Content-Encoding") != "" {
+			t.Error(coding, "Content-Encoding header not removed")
+		}
+	}
+
+	resp := &http.Response{
+		Header: http.Header{},
+		Body:   ioutil.NopCloser(strings.NewReader(content)),
+	}
+	resp.Header.Set("Content-Encoding", "compress")
+
+	if err := decodeBody(resp); err == nil {
+		t.Error("compress is unsupported, but got no err")
+	}
+
+}
+
+func TestCacheHostsGzip(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Write([]byte("fonts.googleapis.com\n"))
+			return
+		}
+
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		gw.Write([]byte("# offline hosts\nfonts.googleapis.com\ncdn.example.com # comment\n"))
+		gw.Close()
+	}))
+	defer srv.Close()
+
+	hosts, err := cacheHosts(srv.URL + "/offline.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "fonts.googleapis.com cdn.example.com"
+	if strings.Join(hosts, " ") != expected {
+		t.Error("Expected:", expected, "But Got:", hosts)
+	}
+}
+
+func TestNormalizeText(t *testing.T) {
+	const page = `<html><head><meta charset="windows-1256"><title>مرحبا</title></head></html>`
+
+	original, err := charmap.Windows1256.NewEncoder().String(page)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	data, contentType, err := normalizeText([]byte(original), "text/html")
+	if err != nil {
+		t.Error("normalizeText() ->", err)
+		return
+	}
+
+	expected := strings.Replace(page, "windows-1256", "utf-8", 1)
+	if string(data) != expected {
+		t.Error("Expected:", expected, "But Got:", string(data))
+	}
+
+	if contentType != "text/html; charset=utf-8" {
+		t.Error("Wrong Content-Type", contentType)
+	}
+
+	*keepCharset = true
+	defer func() { *keepCharset = false }()
+
+	data, contentType, err = normalizeText([]byte(original), "text/html")
+	if err != nil {
+		t.Error("normalizeText() ->", err)
+		return
+	}
+
+	if string(data) != original {
+		t.Error("Expected the original windows-1256 bytes, But Got:", string(data))
+	}
+
+	if contentType != "text/html; charset=windows-1256" {
+		t.Error("Wrong Content-Type", contentType)
+	}
+
+}
+
+func TestSetMetaCharset(t *testing.T) {
+	pages := map[string]string{
+		`<head><meta charset="iso-8859-1"></head>`:                                          `<head><meta charset="utf-8"></head>`,
+		`<head><META http-equiv="Content-Type" content="text/html; charset=latin1"></head>`: `<head><META http-equiv="Content-Type" content="text/html; charset=utf-8"></head>`,
+		`<HEAD lang="en"><title>Hi</title></HEAD>`:                                          `<HEAD lang="en"><meta charset="utf-8"><title>Hi</title></HEAD>`,
+		`<p>no head</p>`: `<p>no head</p>`,
+	}
+
+	for page, expected := range pages {
+		result := setMetaCharset(page, "utf-8")
+		if result != expected {
+			t.Error("Expected:", expected, "But Got:", result)
+		}
+	}
+
+}
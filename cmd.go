@@ -4,7 +4,6 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"strings"
 	"time"
@@ -16,6 +15,10 @@ const (
 	defaultDelayBeforeRequest = 3 * time.Second
 	defaultConcurrency        = 1
 	retryDefaultCount         = 3
+	defaultConnectTimeout     = 30 * time.Second
+	defaultTLSTimeout         = 10 * time.Second
+	defaultHeaderTimeout      = 30 * time.Second
+	defaultReadTimeout        = 30 * time.Second
 	// default
 	defaultDir          = `./`
 	defaultDirAssets    = `assets`
@@ -42,9 +45,18 @@ var (
 	downloadArchive             = flag.Bool("dl-archive", false, "Download archive files")
 	downloadURLsWithQueryString = flag.Bool("dl-query", false, "Download URLs those with query string like https://example.com/?action=msglist&order=desc")
 	ascend                      = flag.Bool("ascend", false, "Ascend to parent directoy when fetching")
+	update                      = flag.Bool("update", false, "Re-fetch mirrored URLs with conditional requests, only changed files are downloaded")
 	retry                       = flag.Bool("retry", false, "Retry fetching directly if fetch failed")
 	retryCount                  = flag.Int("retry-max-count", retryDefaultCount, "Retry fetching this times before giving up")
-	verbose                     = flag.Bool("verbose", false, "Be more verbose")
+	verbose                     = flag.Bool("verbose", false, "Be more verbose, log every URL decision to stderr")
+	logFormat                   = flag.String("log-format", logFormatText, "Log format: text or json, one line per URL decision")
+	logFile                     = flag.String("log-file", "", "Log every URL decision to this file")
+	metricsAddr                 = flag.String("metrics-addr", "", "Serve Prometheus /metrics and /debug/pprof/ on this address, like 127.0.0.1:9090")
+	progressDisabled            = flag.Bool("progress-disabled", false, "Disable the progress status line and periodic progress logs")
+
+	checkLinks  = flag.Bool("check-links", false, "Check links without saving anything, exit with 1 if any is broken")
+	checkFormat = flag.String("check-format", checkFormatText, "Broken links report format: text, json or junit")
+	checkOutput = flag.String("check-output", "", "Write the broken links report to this file instead of stdout")
 
 	dir         = flag.String("dir", defaultDir, "Dirctory root where to store all downloaded files.")
 	dirAssets   = flag.String("dir-assets", defaultDirAssets, "Dirctory where to store assets files.")
@@ -53,6 +65,7 @@ var (
 	dirPages    = flag.String("dir-pages", defaultDirPages, "Dirctory where to store HTML pages.")
 	dirArchives = flag.String("dir-archives", defaultDirArchive, "Directory where to store archive files")
 	dirUnsorted = flag.String("dir-unsorted", defaultDirUnsorted, "Dirctory where to store Unsorted files.")
+	dirMHTML    = flag.String("dir-mhtml", defaultDirMHTML, "Dirctory where to store MHTML files.")
 
 	skippedHosts = flag.String("skipped-hosts", defaultSkippedHosts, "CSV, skip fetching any host that contains any of these values.")
 	skippedURLs  = flag.String("skipped-urls", defaultSkippedURLs, "CSV, skip fetching any url that contains any of these values.")
@@ -60,28 +73,116 @@ var (
 	onlyHosts = flag.String("only-hosts", defaultOnlyHosts, "CSV, Fetch only hosts that contain any of these values.")
 	onlyURLs  = flag.String("only-urls", defaultOnlyURLs, "CSV, Fetch only URLs that contain any of these values.")
 
+	includes  listFlag
+	excludes  listFlag
+	rulesFile = flag.String("rules", "", "File of ordered allow/deny rules, first match wins.")
+
+	acceptMIME  = flag.String("accept-mime", "", "CSV, Fetch only content of these MIME types, wildcards like image/* allowed.")
+	rejectMIME  = flag.String("reject-mime", "", "CSV, skip content of these MIME types, wildcards like image/* allowed.")
+	maxFileSize sizeFlag
+
+	limitRate     sizeFlag
+	limitRateHost sizeFlag
+
+	exportMHTMLs  = flag.Bool("mhtml", false, "Also export each crawled page with its assets as an MHTML file")
+	singleFile    = flag.Bool("single-file", false, "Save each start page as one HTML file with its CSS, JS, fonts and images inlined")
+	inlineMaxSize = sizeFlag(defaultInlineMaxSize)
+
+	warcFile    = flag.String("warc", "", "Also archive requests and raw responses to this WARC file, like crawl.warc.gz")
+	warcMaxSize = sizeFlag(defaultWARCMaxSize)
+
+	outputFile = flag.String("output", "", "Write the mirrored files into this archive instead of -dir: .zip, .tar, .tar.gz or .tar.zst")
+
 	userAgent       = flag.String("user-agent", defaultUserAgent, "UserAgent of the client")
+	cookiesFile     = flag.String("cookies", "", "Load cookies from Netscape/Mozilla cookies.txt file")
+	saveCookies     = flag.String("save-cookies", "", "Save cookies to Netscape/Mozilla cookies.txt file at exit")
+	extraHeaders    listFlag
+	allHostsHeaders listFlag
+	basicAuth       = flag.String("basic-auth", "", "user:pass sent to the start pages hosts only")
+	netrcFile       = flag.String("netrc", "", "Read credentials of the start pages hosts from a netrc file, like ~/.netrc")
+	bearerTokenFile = flag.String("bearer-token-file", "", "Read a bearer token sent to the start pages hosts only from this file")
 	keepMeta        = flag.Bool("keep-meta", false, "Keep original <meta> tags")
+	keepCharset     = flag.Bool("keep-charset", false, "Save HTML, CSS and JS in their original charset instead of UTF-8")
 	offlineDisabled = flag.Bool("offline-disabled", false, "Disable rewriting hosts for offline browsing")
+	searchDisabled  = flag.Bool("search-disabled", false, "Disable building the full-text search index of the saved pages")
+	dedupDisabled   = flag.Bool("dedup-disabled", false, "Disable storing identical files once and hardlinking them")
+	snapshot        = flag.Bool("snapshot", false, "Save this crawl as a new timestamped version inside -dir, sharing unchanged files with earlier ones")
+
+	connectTimeout = flag.Duration("connect-timeout", defaultConnectTimeout, "Timeout of establishing connections")
+	tlsTimeout     = flag.Duration("tls-timeout", defaultTLSTimeout, "Timeout of TLS handshakes")
+	headerTimeout  = flag.Duration("header-timeout", defaultHeaderTimeout, "Timeout of waiting for response headers")
+	readTimeout    = flag.Duration("read-timeout", defaultReadTimeout, "Timeout of waiting for more of a response body, 0 means no timeout")
+	timeout        = flag.Duration("timeout", 0, "Overall timeout of a request including reading the body, 0 means no timeout")
+	proxyURL       = flag.String("proxy", "", "HTTP or SOCKS5 proxy URL like socks5://127.0.0.1:1080, defaults to HTTP_PROXY/HTTPS_PROXY/NO_PROXY env vars")
+	caCert         = flag.String("ca-cert", "", "Trust PEM CA certificates in this file besides the system ones")
+	insecure       = flag.Bool("insecure", false, "Skip verifying TLS certificates")
+	disableHTTP2   = flag.Bool("no-http2", false, "Disable HTTP/2")
 
 	offlineHosts = flag.String("offline-list", defaultOfflineList, "List of websites to be rewriting for offline browsing")
 
 	showVersion = flag.Bool("v", false, "Print version")
 
+	configFile = flag.String("config", "", "Read options from this YAML or TOML file, options given as flags win")
+	profile    = flag.String("profile", "", "Also read the options of this profile of -config, like python-docs")
+
 	// global vars
-	hosts []string
+	hosts    []string
+	urlRules []*rule
+	cookies  *cookieStore
 )
 
 func init() {
 	if os.Geteuid() == 0 || os.Getegid() == 0 {
-		exit(2, "Don't Run as ROOT")
+		fatal(2, "Don't Run as ROOT")
 	}
 
+	flag.Var(&includes, "include", "Fetch only URLs matching this glob or re:REGEXP, repeatable. Globs match the path if they start with /, the URL if they have ://, or else the URL end, like *.pdf")
+	flag.Var(&excludes, "exclude", "Skip URLs matching this glob or re:REGEXP, repeatable, like -include.")
+	flag.Var(&extraHeaders, "header", "Extra `Name: value` header sent to the start pages hosts only, repeatable.")
+	flag.Var(&allHostsHeaders, "header-all-hosts", "Extra `Name: value` header sent to every host, third-party assets hosts included, repeatable.")
+	flag.Var(&limitRate, "limit-rate", "Limit download rate of all workers together to bytes per second, like 500k or 2M.")
+	flag.Var(&limitRateHost, "limit-rate-host", "Limit download rate from each host to bytes per second, like 500k or 2M.")
+	flag.Var(&inlineMaxSize, "inline-max-size", "With -single-file, leave assets larger than this size as links, 0 means no limit.")
+	flag.Var(&warcMaxSize, "warc-max-size", "Start a new WARC file once this size is reached, 0 means no limit.")
+	flag.Var(&maxFileSize, "max-file-size", "Skip files larger than this size, like 500k or 2M, 0 means no limit.")
+
 }
 
 // parseOptions checks the command args for validity
-func parseOptions() error {
-	flag.Parse()
+func parseOptions(args []string) error {
+	flag.CommandLine.Parse(args)
+
+	if *profile != "" && *configFile == "" {
+		return fmt.Errorf("-profile %q needs a -config file", *profile)
+	}
+
+	if *configFile != "" {
+		if err := applyConfig(*configFile, *profile); err != nil {
+			return fmt.Errorf("applyConfig()-> %v", err)
+		}
+	}
+
+	if err := events.open(*logFormat, *logFile); err != nil {
+		return fmt.Errorf("events.open()-> %v", err)
+	}
+
+	switch *checkFormat {
+	case checkFormatText, checkFormatJSON, checkFormatJUnit:
+	default:
+		return fmt.Errorf("unknown -check-format %q, expected text, json or junit", *checkFormat)
+	}
+
+	if *outputFile != "" {
+		if _, err := outputFormat(*outputFile); err != nil {
+			return err
+		}
+	}
+
+	if *snapshot {
+		if err := startSnapshot(time.Now()); err != nil {
+			return err
+		}
+	}
 
 	if *concurrency <= 0 {
 		*concurrency = defaultConcurrency
@@ -91,16 +192,69 @@ func parseOptions() error {
 		*retryCount = 0
 	}
 
-	args := flag.Args()
+	if limitRate > 0 {
+		globalBucket = newBucket(int64(limitRate))
+	}
 
-	if len(args) == 0 {
+	var err error
+	urlRules, err = buildRules(includes, excludes, *rulesFile)
+	if err != nil {
+		return fmt.Errorf("buildRules()-> %v", err)
+	}
+
+	cookies, err = newCookieStore()
+	if err != nil {
+		return fmt.Errorf("newCookieStore()-> %v", err)
+	}
+
+	if *cookiesFile != "" {
+		err = cookies.loadFile(*cookiesFile)
+		if err != nil {
+			return fmt.Errorf("loading cookies %s-> %v", *cookiesFile, err)
+		}
+	}
+
+	transport, err := newTransport()
+	if err != nil {
+		return fmt.Errorf("newTransport()-> %v", err)
+	}
+
+	client.Transport = transport
+	client.Timeout = *timeout
+
+	// stalled bodies don't hold workers forever
+	if *readTimeout > 0 {
+		client.Transport = &idleTimeoutTransport{transport, *readTimeout}
+	}
+	client.Jar = cookies
+
+	err = parseAuthOptions()
+	if err != nil {
+		return fmt.Errorf("parseAuthOptions()-> %v", err)
+	}
+
+	if flag.NArg() == 0 {
 		return fmt.Errorf("Missing URL(s) to work on")
 	}
 
+	if replaying {
+		replayed, err = openWARCArchive(flag.Args())
+		if err != nil {
+			return err
+		}
+
+		client.Transport = replayed
+	}
+
+	// replays don't touch the network, a remote list
+	// is skipped and hosts are not rewritten
+	if !*offlineDisabled && replaying && !strings.HasPrefix(*offlineHosts, "/") {
+		logError("replay: skipping the remote -offline-list", *offlineHosts)
+		*offlineDisabled = true
+	}
+
 	if !*offlineDisabled {
-		var err error
 		hosts, err = cacheHosts(*offlineHosts)
-
 		if err != nil {
 			return fmt.Errorf("cacheHosts()-> %v", err)
 		}
@@ -113,12 +267,23 @@ func parseOptions() error {
 
 //getStartPages gets start page
 func getStartPages() ([]string, error) {
+	return parseStartPages(flag.Args())
+}
+
+// parseStartPages parses the start pages URLs,
+// invalid ones are rejected
+func parseStartPages(args []string) ([]string, error) {
 
 	var pages []string
-	for _, u := range flag.Args() {
+	for _, u := range args {
 		parsed, err := parseURL(u)
-		if err != nil && *verbose {
-			log.Println("Error: parseing", u, "->", err)
+		if err != nil {
+			events.record(&crawlEvent{
+				Event: eventRejected,
+				URL:   u,
+				Rule:  "invalid URL",
+				Error: err.Error(),
+			})
 			continue
 		}
 		pages = append(pages, parsed)
@@ -134,12 +299,12 @@ func getStartPages() ([]string, error) {
 // printVersion prints loca version
 // then exit
 func printVersion() {
-	fmt.Fprintf(os.Stderr, `%v %v (c)(%v)`,
+	fmt.Fprintf(os.Stderr, "%v %v (c)(%v)\n",
 		os.Args[0],
 		version,
 		time.Now().Year(),
 	)
-	exit(1)
+	os.Exit(1)
 }
 
 // cacheHosts graps hosts from remote URL or local file
@@ -161,6 +326,12 @@ func cacheHosts(u string) ([]string, error) {
 	}
 
 	defer resp.Body.Close()
+
+	// Accept-Encoding is set, so the body isn't decoded for us
+	if err := decodeBody(resp); err != nil {
+		return nil, err
+	}
+
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
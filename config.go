@@ -0,0 +1,393 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// sections of a config file, every other key is a flag
+	configProfiles = "profiles"
+	configHosts    = "hosts"
+)
+
+// hostConfig overrides options for the URLs of a host
+// and its subdomains
+type hostConfig struct {
+	Delay   string   `yaml:"delay,omitempty"`
+	Headers []string `yaml:"header,omitempty"`
+	Include []string `yaml:"include,omitempty"`
+	Exclude []string `yaml:"exclude,omitempty"`
+
+	delay   time.Duration
+	headers http.Header
+	rules   []*rule
+}
+
+var (
+	// hostConfigs are the per-host overrides of -config by host
+	hostConfigs = map[string]*hostConfig{}
+)
+
+// readConfig reads the config file p, YAML or TOML by its extension
+func readConfig(p string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	config := map[string]interface{}{}
+
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".toml":
+		err = toml.Unmarshal(data, &config)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &config)
+	default:
+		return nil, fmt.Errorf("unknown -config format %q, expected .yaml or .toml", p)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", p, err)
+	}
+
+	return config, nil
+}
+
+// configStrings gets the string values of a scalar or a list
+func configStrings(v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case []interface{}:
+		var values []string
+
+		for _, item := range v {
+			s, err := configStrings(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, s...)
+		}
+
+		return values, nil
+
+	case map[string]interface{}:
+		return nil, fmt.Errorf("unexpected section")
+
+	case nil:
+		return nil, nil
+	}
+
+	return []string{fmt.Sprint(v)}, nil
+}
+
+// configSection gets the section key of config
+func configSection(config map[string]interface{}, key string) (map[string]interface{}, error) {
+	v, ok := config[key]
+	if !ok {
+		return nil, nil
+	}
+
+	section, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s should be a section", key)
+	}
+
+	return section, nil
+}
+
+// mergeHosts merges the hosts section into hostConfigs,
+// later sections override the options they set
+func mergeHosts(section map[string]interface{}) error {
+	for host, v := range section {
+		options, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("hosts.%s should be a section", host)
+		}
+
+		host = strings.ToLower(host)
+
+		hc, ok := hostConfigs[host]
+		if !ok {
+			hc = &hostConfig{}
+			hostConfigs[host] = hc
+		}
+
+		for key, value := range options {
+			values, err := configStrings(value)
+			if err != nil {
+				return fmt.Errorf("hosts.%s.%s: %v", host, key, err)
+			}
+
+			switch key {
+			case "delay":
+				if len(values) != 1 {
+					return fmt.Errorf("hosts.%s.delay should be a duration", host)
+				}
+				hc.Delay = values[0]
+			case "header":
+				hc.Headers = values
+			case "include":
+				hc.Include = values
+			case "exclude":
+				hc.Exclude = values
+			default:
+				return fmt.Errorf("unknown option hosts.%s.%s, expected delay, header, include or exclude", host, key)
+			}
+		}
+	}
+
+	return nil
+}
+
+// setConfigFlags sets the flags of section, except those in skip
+func setConfigFlags(section map[string]interface{}, skip map[string]bool, origin string) error {
+	var names []string
+	for name := range section {
+		if name != configProfiles && name != configHosts {
+			names = append(names, name)
+		}
+	}
+
+	// list flags get their values in order
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := flag.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("unknown option %s%s", origin, name)
+		}
+
+		if skip[name] {
+			continue
+		}
+
+		values, err := configStrings(section[name])
+		if err != nil {
+			return fmt.Errorf("%s%s: %v", origin, name, err)
+		}
+
+		// repeatable flags take each value,
+		// CSV ones take them joined
+		if l, ok := f.Value.(*listFlag); ok {
+			*l = nil
+
+			for _, v := range values {
+				l.Set(v)
+			}
+			continue
+		}
+
+		if err := f.Value.Set(strings.Join(values, ",")); err != nil {
+			return fmt.Errorf("%s%s: %v", origin, name, err)
+		}
+	}
+
+	return nil
+}
+
+// applyConfig sets the flags not given on the command line
+// from the config file p, then from its profile if any,
+// and builds the per-host overrides
+func applyConfig(p, profile string) error {
+	config, err := readConfig(p)
+	if err != nil {
+		return err
+	}
+
+	// flags win over the config
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	hostConfigs = map[string]*hostConfig{}
+
+	if err := setConfigFlags(config, given, ""); err != nil {
+		return err
+	}
+
+	hosts, err := configSection(config, configHosts)
+	if err != nil {
+		return err
+	}
+
+	if err := mergeHosts(hosts); err != nil {
+		return err
+	}
+
+	if profile != "" {
+		profiles, err := configSection(config, configProfiles)
+		if err != nil {
+			return err
+		}
+
+		section, ok := profiles[profile].(map[string]interface{})
+		if !ok {
+			var names []string
+			for name := range profiles {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			return fmt.Errorf("unknown -profile %q, profiles of %s: %s", profile, p, strings.Join(names, ", "))
+		}
+
+		origin := configProfiles + "." + profile + "."
+
+		if err := setConfigFlags(section, given, origin); err != nil {
+			return err
+		}
+
+		hosts, err := configSection(section, configHosts)
+		if err != nil {
+			return err
+		}
+
+		if err := mergeHosts(hosts); err != nil {
+			return err
+		}
+	}
+
+	return buildHostConfigs()
+}
+
+// buildHostConfigs parses the options of hostConfigs
+func buildHostConfigs() error {
+	for host, hc := range hostConfigs {
+		hc.delay = -1
+
+		if hc.Delay != "" {
+			d, err := time.ParseDuration(hc.Delay)
+			if err != nil {
+				return fmt.Errorf("hosts.%s.delay: %v", host, err)
+			}
+			hc.delay = d
+		}
+
+		hc.headers = http.Header{}
+
+		for _, h := range hc.Headers {
+			name, value, err := parseHeader(h)
+			if err != nil {
+				return fmt.Errorf("hosts.%s.header: %v", host, err)
+			}
+			hc.headers.Add(name, value)
+		}
+
+		rules, err := buildRules(hc.Include, hc.Exclude, "")
+		if err != nil {
+			return fmt.Errorf("hosts.%s: %v", host, err)
+		}
+		hc.rules = rules
+	}
+
+	return nil
+}
+
+// hostOverride gets the overrides of the host of u,
+// the most specific host wins
+func hostOverride(u *url.URL) *hostConfig {
+	if len(hostConfigs) == 0 {
+		return nil
+	}
+
+	host := strings.ToLower(u.Host)
+	name := strings.ToLower(u.Hostname())
+
+	var found *hostConfig
+	longest := 0
+
+	for h, hc := range hostConfigs {
+		if h != host && h != name && !strings.HasSuffix(name, "."+h) {
+			continue
+		}
+
+		if len(h) > longest {
+			found, longest = hc, len(h)
+		}
+	}
+
+	return found
+}
+
+// hostDelay gets the delay before fetching u,
+// delay unless its host overrides it
+func hostDelay(u string, delay time.Duration) time.Duration {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return delay
+	}
+
+	if hc := hostOverride(parsed); hc != nil && hc.delay >= 0 {
+		return hc.delay
+	}
+
+	return delay
+}
+
+// dumpConfig gets the effective options, as in a config file
+func dumpConfig() map[string]interface{} {
+	config := map[string]interface{}{}
+
+	flag.VisitAll(func(f *flag.Flag) {
+		switch f.Name {
+		case "config", "profile", "v":
+			return
+		}
+
+		switch v := f.Value.(type) {
+		case *listFlag:
+			config[f.Name] = append([]string{}, *v...)
+			return
+		case flag.Getter:
+			if _, ok := v.Get().(time.Duration); !ok {
+				config[f.Name] = v.Get()
+				return
+			}
+		}
+
+		config[f.Name] = f.Value.String()
+	})
+
+	if len(hostConfigs) > 0 {
+		config[configHosts] = hostConfigs
+	}
+
+	return config
+}
+
+// runConfig runs `loca config dump [options]`, printing
+// the options merged from -config, -profile and the flags
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "dump" {
+		return fmt.Errorf("expected loca config dump [options]")
+	}
+
+	flag.CommandLine.Parse(args[1:])
+
+	if *configFile != "" {
+		if err := applyConfig(*configFile, *profile); err != nil {
+			return err
+		}
+	}
+
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+
+	if err := enc.Encode(dumpConfig()); err != nil {
+		return err
+	}
+
+	return enc.Close()
+}
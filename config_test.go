@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "loca-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	savedDir, savedDelay, savedLangs, savedSkipped := *dir, *delay, *langs, *skippedHosts
+	savedIncludes := includes
+	defer func() {
+		*dir, *delay, *langs, *skippedHosts = savedDir, savedDelay, savedLangs, savedSkipped
+		includes = savedIncludes
+		hostConfigs = map[string]*hostConfig{}
+		flag.Set("langs", savedLangs)
+	}()
+
+	yamlConfig := `
+dir: mirrors
+delay: 2s
+langs: fr
+skipped-hosts: [youtube.com, vimeo.com]
+hosts:
+  example.com:
+    delay: 500ms
+    header: ["X-Team: docs"]
+profiles:
+  python-docs:
+    dir: python
+    include: ["*://docs.python.org/3/*"]
+    hosts:
+      docs.python.org:
+        exclude: ["/3/whatsnew/**"]
+`
+
+	tomlConfig := `
+dir = "mirrors"
+delay = "2s"
+langs = "fr"
+skipped-hosts = ["youtube.com", "vimeo.com"]
+
+[hosts."example.com"]
+delay = "500ms"
+header = ["X-Team: docs"]
+
+[profiles.python-docs]
+dir = "python"
+include = ["*://docs.python.org/3/*"]
+
+[profiles.python-docs.hosts."docs.python.org"]
+exclude = ["/3/whatsnew/**"]
+`
+
+	// given on the command line
+	flag.Set("langs", "de")
+
+	for name, data := range map[string]string{"loca.yaml": yamlConfig, "loca.toml": tomlConfig} {
+		p := filepath.Join(tmp, name)
+
+		if err := ioutil.WriteFile(p, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := applyConfig(p, "python-docs"); err != nil {
+			t.Fatal(name, err)
+		}
+
+		if *dir != "python" {
+			t.Error("Expected: python", "But Got:", *dir, name)
+		}
+
+		if *delay != 2*time.Second {
+			t.Error("Expected: 2s", "But Got:", *delay, name)
+		}
+
+		if *langs != "de" {
+			t.Error("Expected: de", "But Got:", *langs, name)
+		}
+
+		if *skippedHosts != "youtube.com,vimeo.com" {
+			t.Error("Expected: youtube.com,vimeo.com", "But Got:", *skippedHosts, name)
+		}
+
+		if strings.Join(includes, " ") != "*://docs.python.org/3/*" {
+			t.Error("Expected: *://docs.python.org/3/*", "But Got:", includes, name)
+		}
+
+		if d := hostDelay("https://www.example.com/a", *delay); d != 500*time.Millisecond {
+			t.Error("Expected: 500ms", "But Got:", d, name)
+		}
+
+		if d := hostDelay("https://example.org/a", *delay); d != 2*time.Second {
+			t.Error("Expected: 2s", "But Got:", d, name)
+		}
+
+		req, _ := http.NewRequest("GET", "https://example.com/", nil)
+		setHeaders(req)
+
+		if got := req.Header.Get("X-Team"); got != "docs" {
+			t.Error("Expected: docs", "But Got:", got, name)
+		}
+
+		parsed, _ := url.Parse("https://docs.python.org/3/whatsnew/3.12.html")
+		if r := matchRules(hostOverride(parsed).rules, parsed.String(), parsed); r == nil || r.allow {
+			t.Error("Expected: excluded", "But Got:", r, name)
+		}
+	}
+
+	if err := applyConfig(filepath.Join(tmp, "loca.yaml"), "missing"); err == nil {
+		t.Error("Expected: unknown profile error", "But Got:", err)
+	}
+
+	p := filepath.Join(tmp, "bad.yaml")
+	ioutil.WriteFile(p, []byte("no-such-flag: 1\n"), 0666)
+
+	if err := applyConfig(p, ""); err == nil || !strings.Contains(err.Error(), "no-such-flag") {
+		t.Error("Expected: unknown option no-such-flag", "But Got:", err)
+	}
+}
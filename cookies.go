@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	// httpOnlyPrefix marks HttpOnly cookies in cookies.txt
+	httpOnlyPrefix = "#HttpOnly_"
+)
+
+// cookieStore is a cookie jar shared by all workers,
+// unlike cookiejar.Jar it remembers the cookies it was given
+// so they can be written back to a cookies.txt file
+type cookieStore struct {
+	jar *cookiejar.Jar
+
+	mu      sync.Mutex
+	cookies map[string]*storedCookie
+}
+
+// storedCookie is a cookie with its scope resolved
+type storedCookie struct {
+	http.Cookie
+	// hostOnly cookies were set without a Domain attribute,
+	// they are not sent to subdomains
+	hostOnly bool
+}
+
+// newCookieStore creates an empty cookie store
+func newCookieStore() (*cookieStore, error) {
+	jar, err := cookiejar.New(&cookiejar.Options{
+		PublicSuffixList: publicsuffix.List,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &cookieStore{
+		jar:     jar,
+		cookies: map[string]*storedCookie{},
+	}, nil
+}
+
+// SetCookies implements http.CookieJar
+func (s *cookieStore) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	s.jar.SetCookies(u, cookies)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range cookies {
+		sc := &storedCookie{
+			Cookie:   *c,
+			hostOnly: c.Domain == "",
+		}
+
+		cc := &sc.Cookie
+		cc.Domain = strings.TrimPrefix(cc.Domain, ".")
+
+		if sc.hostOnly {
+			cc.Domain = u.Hostname()
+		}
+
+		if cc.Path == "" || !strings.HasPrefix(cc.Path, "/") {
+			cc.Path = defaultCookiePath(u.Path)
+		}
+
+		if cc.MaxAge > 0 {
+			cc.Expires = time.Now().Add(time.Duration(cc.MaxAge) * time.Second)
+		}
+
+		key := cc.Domain + ";" + cc.Path + ";" + cc.Name
+
+		if cc.MaxAge < 0 || !cc.Expires.IsZero() && cc.Expires.Before(time.Now()) {
+			delete(s.cookies, key)
+			continue
+		}
+
+		if !s.accepted(cc) {
+			continue
+		}
+
+		s.cookies[key] = sc
+	}
+}
+
+// accepted checks whether the jar kept c, cookies for
+// other domains or public suffixes are silently rejected
+func (s *cookieStore) accepted(c *http.Cookie) bool {
+	u := &url.URL{
+		Scheme: "http",
+		Host:   c.Domain,
+		Path:   c.Path,
+	}
+
+	if c.Secure {
+		u.Scheme = "https"
+	}
+
+	if strings.Contains(c.Domain, ":") {
+		u.Host = "[" + c.Domain + "]"
+	}
+
+	for _, jc := range s.jar.Cookies(u) {
+		if jc.Name == c.Name && jc.Value == c.Value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Cookies implements http.CookieJar
+func (s *cookieStore) Cookies(u *url.URL) []*http.Cookie {
+	return s.jar.Cookies(u)
+}
+
+// defaultCookiePath gets the default cookie path of
+// a request path as of RFC 6265 section 5.1.4
+func defaultCookiePath(p string) string {
+	if p == "" || !strings.HasPrefix(p, "/") {
+		return "/"
+	}
+
+	i := strings.LastIndex(p, "/")
+	if i == 0 {
+		return "/"
+	}
+
+	return p[:i]
+}
+
+// load imports Netscape/Mozilla cookies.txt data
+func (s *cookieStore) load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	n := 0
+
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+
+		httpOnly := strings.HasPrefix(line, httpOnlyPrefix)
+		line = strings.TrimPrefix(line, httpOnlyPrefix)
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) < 7 {
+			return fmt.Errorf("line %d: expected 7 tab separated fields", n)
+		}
+
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid expiry %q", n, fields[4])
+		}
+
+		c := &http.Cookie{
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			Name:     fields[5],
+			Value:    strings.Join(fields[6:], "\t"),
+			HttpOnly: httpOnly,
+		}
+
+		// 0 means a session cookie
+		if expires > 0 {
+			c.Expires = time.Unix(expires, 0)
+
+			if c.Expires.Before(time.Now()) {
+				continue
+			}
+		}
+
+		host := strings.TrimPrefix(fields[0], ".")
+
+		// host-only cookies have no Domain attribute
+		if strings.EqualFold(fields[1], "TRUE") {
+			c.Domain = host
+		}
+
+		scheme := "http"
+		if c.Secure {
+			scheme = "https"
+		}
+
+		s.SetCookies(&url.URL{
+			Scheme: scheme,
+			Host:   host,
+			Path:   c.Path,
+		}, []*http.Cookie{c})
+	}
+
+	return scanner.Err()
+}
+
+// write exports the cookies in Netscape/Mozilla cookies.txt format
+func (s *cookieStore) write(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	for k := range s.cookies {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "# Netscape HTTP Cookie File")
+
+	now := time.Now()
+
+	for _, k := range keys {
+		c := s.cookies[k]
+
+		if !c.Expires.IsZero() && c.Expires.Before(now) {
+			continue
+		}
+
+		domain := "." + c.Domain
+		subdomains := "TRUE"
+
+		if c.hostOnly {
+			domain = c.Domain
+			subdomains = "FALSE"
+		}
+
+		if c.HttpOnly {
+			domain = httpOnlyPrefix + domain
+		}
+
+		var expires int64
+		if !c.Expires.IsZero() {
+			expires = c.Expires.Unix()
+		}
+
+		fmt.Fprintf(bw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			domain,
+			subdomains,
+			c.Path,
+			strings.ToUpper(strconv.FormatBool(c.Secure)),
+			expires,
+			c.Name,
+			c.Value,
+		)
+	}
+
+	return bw.Flush()
+}
+
+// loadFile imports a cookies.txt file into the store
+func (s *cookieStore) loadFile(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return s.load(f)
+}
+
+// saveFile writes the cookies to a cookies.txt file atomically
+func (s *cookieStore) saveFile(p string) error {
+	f, err := ioutil.TempFile(filepath.Dir(p), tempFilePrefix)
+	if err != nil {
+		return err
+	}
+
+	if err := s.write(f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), p)
+}
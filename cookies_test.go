@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCookieStore(t *testing.T) {
+	const data = `# Netscape HTTP Cookie File
+.example.com	TRUE	/	FALSE	0	consent	yes
+#HttpOnly_www.example.com	FALSE	/account	TRUE	4102444800	session	a	b
+old.example.com	FALSE	/	FALSE	1	expired	1
+`
+	store, err := newCookieStore()
+	if err != nil {
+		t.Error("newCookieStore() ->", err)
+		return
+	}
+
+	if err := store.load(strings.NewReader(data)); err != nil {
+		t.Error("load() ->", err)
+		return
+	}
+
+	checks := map[string]int{
+		"http://example.com/":                 1,
+		"http://docs.example.com/":            1,
+		"https://www.example.com/account/me":  2,
+		"http://www.example.com/account/me":   1,
+		"https://sub.www.example.com/account": 1,
+		"http://old.example.com/":             1,
+	}
+
+	for u, expected := range checks {
+		parsed, _ := url.Parse(u)
+
+		got := len(store.Cookies(parsed))
+		if got != expected {
+			t.Error(u, "Expected:", expected, "cookies, But Got:", got)
+		}
+	}
+
+	parsed, _ := url.Parse("https://www.example.com/login")
+	store.SetCookies(parsed, []*http.Cookie{
+		{Name: "token", Value: "t", MaxAge: 60},
+		// rejected by the jar
+		{Name: "tracker", Value: "t", Domain: "other.com"},
+		{Name: "supercookie", Value: "t", Domain: "com"},
+	})
+
+	buff := &bytes.Buffer{}
+	if err := store.write(buff); err != nil {
+		t.Error("write() ->", err)
+		return
+	}
+
+	saved := buff.String()
+	lines := []string{
+		".example.com\tTRUE\t/\tFALSE\t0\tconsent\tyes",
+		"#HttpOnly_www.example.com\tFALSE\t/account\tTRUE\t4102444800\tsession\ta\tb",
+		"www.example.com\tFALSE\t/\tFALSE\t",
+	}
+
+	for _, l := range lines {
+		if !strings.Contains(saved, l) {
+			t.Error("write() result doesn't contain", l)
+		}
+	}
+
+	if strings.Contains(saved, "expired") {
+		t.Error("write() result contains expired cookie")
+	}
+
+	for _, name := range []string{"tracker", "supercookie"} {
+		if strings.Contains(saved, name) {
+			t.Error("write() result contains", name, "rejected by the jar")
+		}
+	}
+
+}
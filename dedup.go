@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// objectsDir is the content store inside metaDir,
+	// identical bodies are stored once and hardlinked
+	objectsDir = "objects"
+)
+
+var (
+	// linkFile makes hardlinks, replaced by tests
+	linkFile = os.Link
+)
+
+// fileSum gets the SHA-256 of the file at p
+func fileSum(p string) ([]byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// objectPath gets the path of the body of sum in the content store
+func objectPath(sum []byte) string {
+	s := hex.EncodeToString(sum)
+
+	return storePath(filepath.Join(objectsDir, s[:2], s))
+}
+
+// storeFile moves the finished file tmp into the content store,
+// unless its body is stored already, and links name to it
+func storeFile(tmp, name string, sum []byte) error {
+	var err error
+
+	if sum == nil {
+		sum, err = fileSum(tmp)
+		if err != nil {
+			return err
+		}
+	}
+
+	obj := objectPath(sum)
+
+	fi, err := os.Stat(obj)
+	stored := err == nil
+
+	switch {
+	case stored:
+		// the same body under the same name, like an unchanged page
+		if cur, err := os.Stat(name); err == nil && os.SameFile(fi, cur) {
+			return os.Remove(tmp)
+		}
+
+		if err := os.Remove(tmp); err != nil {
+			return err
+		}
+
+	case os.IsNotExist(err):
+		err = os.MkdirAll(filepath.Dir(obj), 0777)
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(tmp, obj)
+		if err != nil {
+			return err
+		}
+
+	default:
+		return err
+	}
+
+	linked, err := linkObject(obj, name)
+	if err != nil {
+		return err
+	}
+
+	// copies take the space again
+	if stored && linked {
+		events.deduplicated(fi.Size())
+	}
+
+	return nil
+}
+
+// linkObject makes name a hardlink of the stored obj, replacing it,
+// it's a copy where hardlinks aren't supported, linked tells which
+func linkObject(obj, name string) (linked bool, err error) {
+	dir := filepath.Dir(name)
+
+	err = os.MkdirAll(dir, 0777)
+	if err != nil {
+		return false, err
+	}
+
+	// a free name next to name, so the rename is atomic
+	f, err := ioutil.TempFile(dir, tempFilePrefix)
+	if err != nil {
+		return false, err
+	}
+
+	link := f.Name()
+	f.Close()
+
+	if err := os.Remove(link); err != nil {
+		return false, err
+	}
+
+	err = linkFile(obj, link)
+	linked = err == nil
+
+	if err != nil {
+		err = copyFile(obj, link)
+	}
+
+	if err != nil {
+		os.Remove(link)
+		return false, err
+	}
+
+	return linked, os.Rename(link, name)
+}
+
+// copyFile copies the file src to dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+
+	if e := out.Close(); err == nil {
+		err = e
+	}
+
+	return err
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStoreFile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "loca-dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	oldDir := *dir
+	*dir = tmp
+	defer func() {
+		*dir = oldDir
+	}()
+
+	jquery := strings.Repeat("jquery ", 100)
+
+	a := filepath.Join(tmp, "assets", "js", "a.example.com", "jquery.js")
+	b := filepath.Join(tmp, "assets", "js", "b.example.com", "jquery.js")
+
+	saved := events.dedupedBytes
+
+	for _, name := range []string{a, b, b} {
+		if err := saveFile(strings.NewReader(jquery), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fa, err := os.Stat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fb, err := os.Stat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !os.SameFile(fa, fb) {
+		t.Error("Expected:", b, "linked to", a)
+	}
+
+	// saving b again isn't a saving
+	if got := events.dedupedBytes - saved; got != int64(len(jquery)) {
+		t.Error("Expected:", len(jquery), "But Got:", got)
+	}
+
+	// a changed body leaves the other copies alone
+	if err := saveFile(strings.NewReader("changed"), b); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(a)
+	if string(data) != jquery {
+		t.Error("Expected:", jquery, "But Got:", string(data))
+	}
+
+	data, _ = ioutil.ReadFile(b)
+	if string(data) != "changed" {
+		t.Error("Expected: changed", "But Got:", string(data))
+	}
+
+	objects, _ := filepath.Glob(metaPath(filepath.Join(objectsDir, "*", "*")))
+	if len(objects) != 2 {
+		t.Error("Expected: 2", "But Got:", len(objects))
+	}
+}
+
+func TestStoreFileWithoutHardlinks(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "loca-dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	oldDir := *dir
+	*dir = tmp
+	defer func() {
+		*dir = oldDir
+		linkFile = os.Link
+	}()
+
+	// like a filesystem without hardlinks
+	linkFile = func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrPermission}
+	}
+
+	body := strings.Repeat("font ", 100)
+	saved := events.dedupedBytes
+
+	for _, host := range []string{"a.example.com", "b.example.com"} {
+		name := filepath.Join(tmp, "assets", "fonts", host, "font.woff")
+
+		if err := saveFile(strings.NewReader(body), name); err != nil {
+			t.Fatal(err)
+		}
+
+		data, _ := ioutil.ReadFile(name)
+		if string(data) != body {
+			t.Error("Expected:", body, "But Got:", string(data))
+		}
+	}
+
+	// copies save nothing
+	if got := events.dedupedBytes - saved; got != 0 {
+		t.Error("Expected: 0", "But Got:", got)
+	}
+}
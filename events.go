@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// URL decisions and outcomes
+	eventQueued    = "queued"
+	eventRejected  = "rejected"
+	eventSkipped   = "skipped"
+	eventFetched   = "fetched"
+	eventUnchanged = "unchanged"
+	eventRetry     = "retry"
+	eventFailed    = "failed"
+	// -check-links outcomes
+	eventChecked = "checked"
+	eventBroken  = "broken"
+	// errors not tied to an URL
+	eventError = "error"
+
+	// ruleExists skips URLs already mirrored
+	ruleExists = "exists"
+
+	logFormatText = "text"
+	logFormatJSON = "json"
+
+	// maxReferrers are the most pages remembered linking
+	// to an URL, so memory doesn't grow with every link
+	maxReferrers = 100
+)
+
+// crawlEvent is a single URL decision or outcome,
+// written as one JSON line with -log-format=json
+type crawlEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	URL      string    `json:"url,omitempty"`
+	From     string    `json:"from,omitempty"`
+	Rule     string    `json:"rule,omitempty"`
+	Status   int       `json:"status,omitempty"`
+	Bytes    int64     `json:"bytes,omitempty"`
+	Duration float64   `json:"duration_ms,omitempty"`
+	File     string    `json:"file,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// String formats the event as a text log line
+func (e *crawlEvent) String() string {
+	parts := []string{
+		e.Time.Format("2006/01/02 15:04:05"),
+		e.Event,
+	}
+
+	if e.Status != 0 {
+		parts = append(parts, fmt.Sprint(e.Status))
+	}
+
+	if e.URL != "" {
+		parts = append(parts, e.URL)
+	}
+
+	if e.From != "" {
+		parts = append(parts, "<- "+e.From)
+	}
+
+	if e.Rule != "" {
+		parts = append(parts, "by "+e.Rule)
+	}
+
+	if e.File != "" {
+		parts = append(parts, "-> "+e.File,
+			formatSize(e.Bytes),
+			time.Duration(e.Duration*float64(time.Millisecond)).Round(time.Millisecond).String(),
+		)
+	}
+
+	if e.Error != "" {
+		parts = append(parts, e.Error)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// eventLog records crawl events and keeps the run statistics
+type eventLog struct {
+	mu sync.Mutex
+
+	json bool
+	// file gets all events, stderr gets failures
+	// unless -verbose
+	file   io.WriteCloser
+	stderr io.Writer
+
+	// referrers maps URLs to the pages linking them,
+	// in discovery order, up to maxReferrers each
+	referrers map[string][]string
+
+	started  time.Time
+	counts   map[string]int
+	statuses map[int]int
+	bytes    int64
+	// received are the bytes of response bodies read so far,
+	// downloads in progress included
+	received int64
+
+	// files already in the content store and their bytes
+	deduped      int
+	dedupedBytes int64
+}
+
+var (
+	// events is the log of the current run
+	events = newEventLog(os.Stderr)
+)
+
+// newEventLog creates a text event log writing to stderr
+func newEventLog(stderr io.Writer) *eventLog {
+	return &eventLog{
+		stderr:    stderr,
+		referrers: map[string][]string{},
+		started:   time.Now(),
+		counts:    map[string]int{},
+		statuses:  map[int]int{},
+	}
+}
+
+// open sets the log format and file from -log-format and -log-file
+func (l *eventLog) open(format, file string) error {
+	switch format {
+	case logFormatText:
+	case logFormatJSON:
+		l.json = true
+	default:
+		return fmt.Errorf("unknown -log-format %q, expected text or json", format)
+	}
+
+	if file == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+
+	l.file = f
+
+	return nil
+}
+
+// format formats e as a log line
+func (l *eventLog) format(e *crawlEvent) []byte {
+	if !l.json {
+		return []byte(e.String() + "\n")
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return []byte(e.String() + "\n")
+	}
+
+	return append(data, '\n')
+}
+
+// record writes the event and counts it
+func (l *eventLog) record(e *crawlEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	line := l.format(e)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.counts[e.Event]++
+
+	if e.Status != 0 {
+		l.statuses[e.Status]++
+	}
+
+	if e.Event == eventFetched {
+		l.bytes += e.Bytes
+	}
+
+	metrics.observe(e)
+
+	if l.file != nil {
+		l.file.Write(line)
+	}
+
+	if *verbose || e.Event == eventFailed ||
+		e.Event == eventBroken || e.Event == eventError {
+		l.stderr.Write(line)
+	}
+}
+
+// snapshot gets a copy of the event counts and the received bytes
+func (l *eventLog) snapshot() (map[string]int, int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	counts := map[string]int{}
+	for k, v := range l.counts {
+		counts[k] = v
+	}
+
+	return counts, l.received
+}
+
+// read counts n more bytes read of a response body
+func (l *eventLog) read(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.received += int64(n)
+}
+
+// setStderr changes where failures and -verbose events go
+func (l *eventLog) setStderr(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.stderr = w
+}
+
+// discovered remembers that from links to u,
+// and whether u was never discovered before
+func (l *eventLog) discovered(u, from string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	refs := l.referrers[u]
+	if len(refs) >= maxReferrers {
+		return false
+	}
+
+	for _, r := range refs {
+		if r == from {
+			return false
+		}
+	}
+
+	l.referrers[u] = append(refs, from)
+
+	return len(refs) == 0
+}
+
+// referrer gets the first page linking to u
+func (l *eventLog) referrer(u string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if refs := l.referrers[u]; len(refs) > 0 {
+		return refs[0]
+	}
+
+	return ""
+}
+
+// referrersOf gets all pages linking to u
+func (l *eventLog) referrersOf(u string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]string(nil), l.referrers[u]...)
+}
+
+// summary prints the counts of the run as a table
+func (l *eventLog) summary(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+
+	kinds := []string{
+		eventQueued, eventRejected, eventSkipped, eventFetched,
+		eventUnchanged, eventRetry, eventFailed,
+	}
+
+	if *checkLinks {
+		kinds = []string{
+			eventQueued, eventRejected, eventChecked,
+			eventRetry, eventBroken,
+		}
+	}
+
+	for _, k := range kinds {
+		fmt.Fprintf(tw, "%s\t%d\t\n", k, l.counts[k])
+	}
+
+	var codes []int
+	for code := range l.statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+
+	for _, code := range codes {
+		fmt.Fprintf(tw, "HTTP %d\t%d\t\n", code, l.statuses[code])
+	}
+
+	elapsed := time.Since(l.started)
+
+	fmt.Fprintf(tw, "bytes\t%s\t\n", formatSize(l.bytes))
+
+	if l.deduped > 0 {
+		fmt.Fprintf(tw, "deduplicated\t%d\t\n", l.deduped)
+		fmt.Fprintf(tw, "saved\t%s\t\n", formatSize(l.dedupedBytes))
+	}
+
+	fmt.Fprintf(tw, "elapsed\t%s\t\n", elapsed.Round(time.Millisecond))
+	fmt.Fprintf(tw, "rate\t%s/s\t\n",
+		formatSize(int64(float64(l.bytes)/elapsed.Seconds())),
+	)
+
+	tw.Flush()
+}
+
+// deduplicated counts a file whose body was stored already
+func (l *eventLog) deduplicated(size int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.deduped++
+	l.dedupedBytes += size
+}
+
+// close closes the -log-file
+func (l *eventLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Close()
+	l.file = nil
+
+	return err
+}
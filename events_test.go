@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type nopWriteCloser struct {
+	*bytes.Buffer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestEventLog(t *testing.T) {
+	stderr := &bytes.Buffer{}
+	file := &bytes.Buffer{}
+
+	l := newEventLog(stderr)
+	l.json = true
+	l.file = nopWriteCloser{file}
+
+	if !l.discovered("https://example.com/about", "https://example.com/") {
+		t.Error("Expected: first discovery", "But Got: false")
+	}
+
+	if l.discovered("https://example.com/about", "https://example.com/faqs") {
+		t.Error("Expected: already discovered", "But Got: true")
+	}
+
+	if from := l.referrer("https://example.com/about"); from != "https://example.com/" {
+		t.Error("Expected the first referrer, But Got:", from)
+	}
+
+	l.discovered("https://example.com/about", "https://example.com/")
+
+	if refs := l.referrersOf("https://example.com/about"); len(refs) != 2 {
+		t.Error("Expected 2 distinct referrers, But Got:", refs)
+	}
+
+	for i := 0; i < 2*maxReferrers; i++ {
+		l.discovered("https://example.com/", fmt.Sprintf("https://example.com/%d", i))
+	}
+
+	if refs := l.referrersOf("https://example.com/"); len(refs) != maxReferrers {
+		t.Error("Expected:", maxReferrers, "referrers", "But Got:", len(refs))
+	}
+
+	l.record(&crawlEvent{Event: eventFetched, URL: "https://example.com/", Status: 200, Bytes: 2048})
+	l.record(&crawlEvent{Event: eventRejected, URL: "https://example.com/x.pdf", Rule: "-exclude"})
+	l.record(&crawlEvent{Event: eventFailed, URL: "https://example.com/about", Status: 404})
+
+	lines := strings.Split(strings.TrimSpace(file.String()), "\n")
+	if len(lines) != 3 {
+		t.Error("Expected 3 JSON lines, But Got:", len(lines))
+		return
+	}
+
+	ev := &crawlEvent{}
+	if err := json.Unmarshal([]byte(lines[1]), ev); err != nil {
+		t.Error("Invalid JSON line", lines[1], err)
+	}
+
+	if ev.Rule != "-exclude" || ev.Event != eventRejected {
+		t.Error("Wrong decoded event", ev)
+	}
+
+	// only failures go to stderr without -verbose
+	if strings.Count(stderr.String(), "\n") != 1 {
+		t.Error("Expected only the failure on stderr, But Got:", stderr.String())
+	}
+
+	summary := &bytes.Buffer{}
+	l.summary(summary)
+
+	checks := []string{"fetched  1", "rejected  1", "failed  1", "404  1", "bytes  2K"}
+	for _, c := range checks {
+		if !strings.Contains(reWhitespace.ReplaceAllString(summary.String(), "  "), c) {
+			t.Error("summary doesn't contain", c)
+		}
+	}
+
+}
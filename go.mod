@@ -1,6 +1,20 @@
 module github.com/coderme/loca
 
+go 1.27.1
+
 require (
-	github.com/coderme/filo v0.0.0-20190815104728-e97f9bdca786
+	github.com/BurntSushi/toml v1.4.0
+	github.com/andybalholm/brotli v1.0.0
+	github.com/andybalholm/cascadia v1.0.0
+	github.com/codermeorg/filo v0.0.0-20190815104728-e97f9bdca786
+	github.com/klauspost/compress v1.17.11
 	golang.org/x/net v0.0.0-20190813141303-74dc4d7220e7
+	golang.org/x/text v0.3.2
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2 // indirect
+	golang.org/x/sys v0.0.0-20190215142949-d0b11bdaac8a // indirect
+	golang.org/x/tools v0.0.0-20180917221912-90fa682c2a6e // indirect
 )
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	graphName = "graph.jsonl"
+
+	// link types
+	edgeStart = "start"
+	edgeLink  = "link"
+	edgeAsset = "asset"
+	// edgeReset drops the earlier edges from a page,
+	// recorded when the page is fetched again
+	edgeReset = "reset"
+
+	graphFormatDOT     = "dot"
+	graphFormatGraphML = "graphml"
+	graphFormatCSV     = "csv"
+	graphFormatNodes   = "nodes"
+)
+
+// linkEdge is a link from a page to an URL, start pages
+// are edges of type start without a source
+type linkEdge struct {
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	Type string `json:"type"`
+}
+
+// linkGraph records the edges discovered while crawling,
+// as JSON lines appended to graph.jsonl inside metaDir
+type linkGraph struct {
+	mu   sync.Mutex
+	f    *os.File
+	seen map[linkEdge]bool
+	// out are the edges of previous runs by page,
+	// until the page is fetched again
+	out map[string][]linkEdge
+}
+
+var (
+	// graph is nil unless mirroring
+	graph *linkGraph
+)
+
+// openGraph opens the graph file at p for appending,
+// edges of previous runs aren't recorded again
+func openGraph(p string) (*linkGraph, error) {
+	edges, err := loadGraph(p)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	g := &linkGraph{
+		seen: map[linkEdge]bool{},
+		out:  map[string][]linkEdge{},
+	}
+
+	for _, e := range edges {
+		g.seen[e] = true
+
+		if e.From != "" {
+			g.out[e.From] = append(g.out[e.From], e)
+		}
+	}
+
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	g.f = f
+
+	return g, nil
+}
+
+// add records an edge, once
+func (g *linkGraph) add(from, to, kind string) error {
+	if g == nil {
+		return nil
+	}
+
+	e := linkEdge{From: from, To: to, Type: kind}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.seen[e] {
+		return nil
+	}
+
+	g.seen[e] = true
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = g.f.Write(append(data, '\n'))
+
+	return err
+}
+
+// reset drops the edges of previous runs from page,
+// so its links are the ones of the fetched version
+func (g *linkGraph) reset(page string) error {
+	if g == nil {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	edges, ok := g.out[page]
+	if !ok {
+		return nil
+	}
+
+	delete(g.out, page)
+
+	for _, e := range edges {
+		delete(g.seen, e)
+	}
+
+	data, err := json.Marshal(linkEdge{From: page, Type: edgeReset})
+	if err != nil {
+		return err
+	}
+
+	_, err = g.f.Write(append(data, '\n'))
+
+	return err
+}
+
+// close closes the graph file
+func (g *linkGraph) close() error {
+	if g == nil {
+		return nil
+	}
+
+	return g.f.Close()
+}
+
+// loadGraph reads the distinct edges of the graph file at p,
+// without the ones dropped by a reset of their page
+func loadGraph(p string) ([]linkEdge, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var all []linkEdge
+	seen := map[linkEdge]bool{}
+	// out are the indexes of the edges by page
+	out := map[string][]int{}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		var e linkEdge
+		// a crashed run may leave a truncated last line
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			continue
+		}
+
+		if e.Type == edgeReset {
+			for _, i := range out[e.From] {
+				delete(seen, all[i])
+				all[i].Type = edgeReset
+			}
+			delete(out, e.From)
+			continue
+		}
+
+		if seen[e] {
+			continue
+		}
+
+		seen[e] = true
+		out[e.From] = append(out[e.From], len(all))
+		all = append(all, e)
+	}
+
+	var edges []linkEdge
+	for _, e := range all {
+		if e.Type != edgeReset {
+			edges = append(edges, e)
+		}
+	}
+
+	return edges, nil
+}
+
+// graphNode is an URL of the graph with its degrees,
+// depth is -1 when it can't be reached from the start pages
+type graphNode struct {
+	URL   string
+	In    int
+	Out   int
+	Depth int
+}
+
+// analyzeGraph computes the in-degree, out-degree and depth
+// from the start pages of every URL, sorted by URL
+func analyzeGraph(edges []linkEdge) []*graphNode {
+	nodes := map[string]*graphNode{}
+	next := map[string][]string{}
+
+	node := func(u string) *graphNode {
+		n, ok := nodes[u]
+		if !ok {
+			n = &graphNode{URL: u, Depth: -1}
+			nodes[u] = n
+		}
+		return n
+	}
+
+	var queue []string
+
+	for _, e := range edges {
+		to := node(e.To)
+
+		if e.Type == edgeStart {
+			if to.Depth != 0 {
+				to.Depth = 0
+				queue = append(queue, e.To)
+			}
+			continue
+		}
+
+		node(e.From).Out++
+		to.In++
+		next[e.From] = append(next[e.From], e.To)
+	}
+
+	// breadth first, so the first depth found is the shortest
+	for len(queue) > 0 {
+		u := queue[0]
+		queue = queue[1:]
+
+		for _, v := range next[u] {
+			if n := nodes[v]; n.Depth == -1 {
+				n.Depth = nodes[u].Depth + 1
+				queue = append(queue, v)
+			}
+		}
+	}
+
+	var sorted []*graphNode
+	for _, n := range nodes {
+		sorted = append(sorted, n)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].URL < sorted[j].URL
+	})
+
+	return sorted
+}
+
+// graphMLData is a GraphML data element
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+// graphMLKey declares a GraphML attribute
+type graphMLKey struct {
+	ID   string `xml:"id,attr"`
+	For  string `xml:"for,attr"`
+	Name string `xml:"attr.name,attr"`
+	Type string `xml:"attr.type,attr"`
+}
+
+// graphMLNode is a GraphML node
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+// graphMLEdge is a GraphML edge
+type graphMLEdge struct {
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+// graphML is a GraphML document
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   struct {
+		ID          string        `xml:"id,attr"`
+		EdgeDefault string        `xml:"edgedefault,attr"`
+		Nodes       []graphMLNode `xml:"node"`
+		Edges       []graphMLEdge `xml:"edge"`
+	} `xml:"graph"`
+}
+
+// writeGraph writes the edges in format
+func writeGraph(w io.Writer, edges []linkEdge, format string) error {
+	nodes := analyzeGraph(edges)
+
+	var links []linkEdge
+	for _, e := range edges {
+		if e.Type != edgeStart {
+			links = append(links, e)
+		}
+	}
+
+	switch format {
+	case graphFormatDOT:
+		bw := bufio.NewWriter(w)
+
+		fmt.Fprintln(bw, "digraph loca {")
+		for _, n := range nodes {
+			fmt.Fprintf(bw, "  %s [comment=\"in %d out %d depth %d\"];\n",
+				strconv.Quote(n.URL), n.In, n.Out, n.Depth,
+			)
+		}
+		for _, e := range links {
+			fmt.Fprintf(bw, "  %s -> %s [label=%s];\n",
+				strconv.Quote(e.From), strconv.Quote(e.To), strconv.Quote(e.Type),
+			)
+		}
+		fmt.Fprintln(bw, "}")
+
+		return bw.Flush()
+
+	case graphFormatGraphML:
+		doc := &graphML{
+			XMLNS: "http://graphml.graphdrawing.org/xmlns",
+			Keys: []graphMLKey{
+				{ID: "in", For: "node", Name: "in_degree", Type: "int"},
+				{ID: "out", For: "node", Name: "out_degree", Type: "int"},
+				{ID: "depth", For: "node", Name: "depth", Type: "int"},
+				{ID: "type", For: "edge", Name: "type", Type: "string"},
+			},
+		}
+		doc.Graph.ID = "loca"
+		doc.Graph.EdgeDefault = "directed"
+
+		for _, n := range nodes {
+			doc.Graph.Nodes = append(doc.Graph.Nodes, graphMLNode{
+				ID: n.URL,
+				Data: []graphMLData{
+					{"in", strconv.Itoa(n.In)},
+					{"out", strconv.Itoa(n.Out)},
+					{"depth", strconv.Itoa(n.Depth)},
+				},
+			})
+		}
+
+		for _, e := range links {
+			doc.Graph.Edges = append(doc.Graph.Edges, graphMLEdge{
+				Source: e.From,
+				Target: e.To,
+				Data:   []graphMLData{{"type", e.Type}},
+			})
+		}
+
+		io.WriteString(w, xml.Header)
+
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "  ")
+		if err := enc.Encode(doc); err != nil {
+			return err
+		}
+
+		_, err := io.WriteString(w, "\n")
+		return err
+
+	case graphFormatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"source", "target", "type"})
+
+		for _, e := range links {
+			cw.Write([]string{e.From, e.To, e.Type})
+		}
+
+		cw.Flush()
+		return cw.Error()
+
+	case graphFormatNodes:
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"url", "in_degree", "out_degree", "depth"})
+
+		for _, n := range nodes {
+			cw.Write([]string{
+				n.URL,
+				strconv.Itoa(n.In),
+				strconv.Itoa(n.Out),
+				strconv.Itoa(n.Depth),
+			})
+		}
+
+		cw.Flush()
+		return cw.Error()
+	}
+
+	return fmt.Errorf("unknown graph format %q", format)
+}
+
+// runGraph runs `loca graph`, exporting the link graph of the mirror
+func runGraph(args []string) error {
+	fs := flag.NewFlagSet("graph", flag.ExitOnError)
+	fs.StringVar(dir, "dir", *dir, "Dirctory root of the mirror.")
+	format := fs.String("format", graphFormatDOT, "Output format: dot, graphml, csv edge list or nodes with their in-degree, out-degree and depth")
+	outFile := fs.String("o", "", "Write to this file instead of stdout")
+	fs.Parse(args)
+
+	switch *format {
+	case graphFormatDOT, graphFormatGraphML, graphFormatCSV, graphFormatNodes:
+	default:
+		return fmt.Errorf("unknown -format %q, expected dot, graphml, csv or nodes", *format)
+	}
+
+	edges, err := loadGraph(metaPath(graphName))
+	if err != nil {
+		return fmt.Errorf("loadGraph()-> %v", err)
+	}
+
+	if *outFile == "" {
+		return writeGraph(os.Stdout, edges, *format)
+	}
+
+	f, err := os.Create(*outFile)
+	if err != nil {
+		return err
+	}
+
+	err = writeGraph(f, edges, *format)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+
+	return err
+}
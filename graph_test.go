@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLinkGraph(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "loca-graph")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	p := filepath.Join(tmp, graphName)
+
+	g, err := openGraph(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g.add("", "https://example.com/", edgeStart)
+	g.add("https://example.com/", "https://example.com/about", edgeLink)
+	g.add("https://example.com/", "https://example.com/logo.png", edgeAsset)
+	g.add("https://example.com/about", "https://example.com/team", edgeLink)
+	g.add("https://example.com/about", "https://example.com/", edgeLink)
+	g.add("https://example.com/orphan", "https://example.com/about", edgeLink)
+	g.close()
+
+	// a later run records only new edges
+	g, err = openGraph(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.add("https://example.com/", "https://example.com/about", edgeLink)
+	g.close()
+
+	edges, err := loadGraph(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(edges) != 6 {
+		t.Error("Expected: 6 edges", "But Got:", len(edges))
+	}
+
+	expected := map[string]graphNode{
+		"https://example.com/":         {In: 1, Out: 2, Depth: 0},
+		"https://example.com/about":    {In: 2, Out: 2, Depth: 1},
+		"https://example.com/logo.png": {In: 1, Out: 0, Depth: 1},
+		"https://example.com/team":     {In: 1, Out: 0, Depth: 2},
+		"https://example.com/orphan":   {In: 0, Out: 1, Depth: -1},
+	}
+
+	nodes := analyzeGraph(edges)
+	if len(nodes) != len(expected) {
+		t.Error("Expected:", len(expected), "nodes", "But Got:", len(nodes))
+	}
+
+	for _, n := range nodes {
+		e := expected[n.URL]
+		if n.In != e.In || n.Out != e.Out || n.Depth != e.Depth {
+			t.Error("Expected:", e, "But Got:", *n)
+		}
+	}
+
+	out := &bytes.Buffer{}
+	writeGraph(out, edges, graphFormatCSV)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 6 || lines[0] != "source,target,type" ||
+		lines[1] != "https://example.com/,https://example.com/about,link" {
+		t.Error("Unexpected CSV:", out.String())
+	}
+
+	out.Reset()
+	writeGraph(out, edges, graphFormatDOT)
+	if !strings.Contains(out.String(), `"https://example.com/" -> "https://example.com/logo.png" [label="asset"];`) ||
+		!strings.Contains(out.String(), `"https://example.com/team" [comment="in 1 out 0 depth 2"];`) {
+		t.Error("Unexpected DOT:", out.String())
+	}
+
+	out.Reset()
+	writeGraph(out, edges, graphFormatGraphML)
+	doc := &graphML{}
+	if err := xml.Unmarshal(out.Bytes(), doc); err != nil ||
+		len(doc.Graph.Nodes) != 5 || len(doc.Graph.Edges) != 5 {
+		t.Error("Unexpected GraphML:", err, out.String())
+	}
+
+	out.Reset()
+	writeGraph(out, edges, graphFormatNodes)
+	if !strings.Contains(out.String(), "https://example.com/orphan,0,1,-1\n") {
+		t.Error("Unexpected nodes:", out.String())
+	}
+}
+
+func TestLinkGraphReset(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "loca-graph")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	p := filepath.Join(tmp, graphName)
+
+	g, err := openGraph(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.add("", "https://example.com/", edgeStart)
+	g.add("https://example.com/", "https://example.com/old", edgeLink)
+	g.add("https://example.com/", "https://example.com/about", edgeLink)
+	g.close()
+
+	// the page is fetched again, without the old link
+	g, err = openGraph(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.reset("https://example.com/")
+	g.add("https://example.com/", "https://example.com/about", edgeLink)
+	g.add("https://example.com/", "https://example.com/new", edgeLink)
+	// once per run
+	g.reset("https://example.com/")
+	g.close()
+
+	edges, err := loadGraph(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, e := range edges {
+		got = append(got, e.To)
+	}
+
+	expected := "https://example.com/ https://example.com/about https://example.com/new"
+	if strings.Join(got, " ") != expected {
+		t.Error("Expected:", expected, "But Got:", got)
+	}
+}
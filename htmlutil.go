@@ -46,3 +46,23 @@ func prettyURL(ugly string) (pretty string) {
 	return
 
 }
+
+// setMetaCharset makes <meta charset> declare name,
+// one is added to <head> if missing
+func setMetaCharset(s, name string) string {
+	if reMetaCharset.MatchString(s) {
+		return reMetaCharset.ReplaceAllString(s, "${1}"+name)
+	}
+
+	loc := reHead.FindStringIndex(s)
+	if loc == nil {
+		return s
+	}
+
+	return s[:loc[1]] + `<meta charset="` + name + `">` + s[loc[1]:]
+}
+
+// setCSSCharset makes @charset of a stylesheet declare name
+func setCSSCharset(s, name string) string {
+	return reCSSCharset.ReplaceAllLiteralString(s, `@charset "`+name+`";`)
+}
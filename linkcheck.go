@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	checkFormatText  = "text"
+	checkFormatJSON  = "json"
+	checkFormatJUnit = "junit"
+)
+
+// linkResult is the outcome of checking a link
+type linkResult struct {
+	URL       string   `json:"url"`
+	Status    int      `json:"status,omitempty"`
+	Reason    string   `json:"reason,omitempty"`
+	Referrers []string `json:"referrers,omitempty"`
+	broken    bool
+}
+
+// linkReport is what -check-links outputs
+type linkReport struct {
+	Checked int           `json:"checked"`
+	Broken  []*linkResult `json:"broken"`
+	all     []*linkResult
+}
+
+var (
+	// checked keeps the results of -check-links by URL
+	checked   = map[string]*linkResult{}
+	checkedMu sync.Mutex
+)
+
+// isInternal checks whether u is on one of the start pages hosts
+func isInternal(u string) bool {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+
+	for _, p := range pages {
+		start, err := url.Parse(p)
+		if err != nil {
+			continue
+		}
+
+		if strings.EqualFold(start.Host, parsed.Host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requestLink sends a method request to u after the delay
+// of its host
+func requestLink(method, u string) (*http.Response, error) {
+	waitDelay(u, *delay)
+
+	req, err := buildRequest(u, *userAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Method = method
+
+	return client.Do(req)
+}
+
+// probeLink requests u, internal pages are fetched with GET to
+// discover their links, external links are checked with HEAD
+// falling back to GET for servers that don't support it
+func probeLink(u string, internal bool) (*http.Response, error) {
+	if !internal {
+		resp, err := requestLink(http.MethodHead, u)
+		if err == nil && resp.StatusCode < http.StatusBadRequest {
+			return resp, nil
+		}
+
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+
+	resp, err := requestLink(http.MethodGet, u)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		resp.Body.Close()
+		return nil, &statusError{
+			url:    u,
+			code:   resp.StatusCode,
+			status: resp.Status,
+		}
+	}
+
+	return resp, nil
+}
+
+// checkLink checks u without saving it, returning the links
+// of internal HTML pages. The outcome is recorded to the events log
+func checkLink(u string) ([]string, error) {
+	allowed, reason, err := filterURL(u)
+	if err != nil || !allowed {
+		events.record(&crawlEvent{
+			Event: eventRejected,
+			URL:   u,
+			From:  events.referrer(u),
+			Rule:  reason,
+		})
+		return nil, nil
+	}
+
+	ev := &crawlEvent{
+		Event: eventChecked,
+		URL:   u,
+		From:  events.referrer(u),
+	}
+	started := time.Now()
+	result := &linkResult{URL: u}
+
+	defer func() {
+		ev.Duration = float64(time.Since(started)) / float64(time.Millisecond)
+		ev.Status = result.Status
+
+		if result.broken {
+			ev.Event = eventBroken
+			ev.Error = result.Reason
+		}
+
+		events.record(ev)
+
+		checkedMu.Lock()
+		checked[u] = result
+		checkedMu.Unlock()
+	}()
+
+	internal := isInternal(u)
+
+	var resp *http.Response
+
+	for attempt := 0; ; attempt++ {
+		resp, err = probeLink(u, internal)
+
+		if err == nil || !*retry ||
+			attempt >= *retryCount || !isRetryable(err) {
+			break
+		}
+
+		events.record(&crawlEvent{
+			Event: eventRetry,
+			URL:   u,
+			Error: err.Error(),
+		})
+	}
+
+	if err != nil {
+		result.broken = true
+		result.Reason = err.Error()
+
+		if e, ok := err.(*statusError); ok {
+			result.Status = e.code
+			result.Reason = http.StatusText(e.code)
+		}
+
+		return nil, nil
+	}
+
+	defer resp.Body.Close()
+
+	result.Status = resp.StatusCode
+	result.Reason = http.StatusText(resp.StatusCode)
+
+	// only internal pages are crawled
+	if !internal || !isHTML(resp.Header.Get("Content-Type")) {
+		return nil, nil
+	}
+
+	err = decodeBody(resp)
+	if err != nil {
+		return nil, fmt.Errorf("Err: decodeBody(%s) -> %v", u, err)
+	}
+
+	limitBody(resp, 0)
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Err: checkLink(%s) -> %v", u, err)
+	}
+
+	s, _, _ := decodeText(data, resp.Header.Get("Content-Type"))
+
+	return filterDiscovered(u, s), nil
+}
+
+// newLinkReport collects the checked links with their referrers,
+// broken links first sorted by URL
+func newLinkReport() *linkReport {
+	checkedMu.Lock()
+	defer checkedMu.Unlock()
+
+	report := &linkReport{
+		Checked: len(checked),
+		Broken:  []*linkResult{},
+	}
+
+	for u, result := range checked {
+		result.Referrers = events.referrersOf(u)
+		report.all = append(report.all, result)
+	}
+
+	sort.Slice(report.all, func(i, j int) bool {
+		a, b := report.all[i], report.all[j]
+		if a.broken != b.broken {
+			return a.broken
+		}
+		return a.URL < b.URL
+	})
+
+	for _, result := range report.all {
+		if result.broken {
+			report.Broken = append(report.Broken, result)
+		}
+	}
+
+	return report
+}
+
+// junitTestSuite is the JUnit XML of a link report,
+// a test case per checked link
+type junitTestSuite struct {
+	XMLName  xml.Name        `xml:"testsuite"`
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+// junitTestCase is a checked link
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+// junitFailure is why a link is broken
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// describe formats the status and reason of a result
+func (r *linkResult) describe() string {
+	if r.Status == 0 {
+		return r.Reason
+	}
+
+	return fmt.Sprintf("%d %s", r.Status, r.Reason)
+}
+
+// write writes the report in format
+func (r *linkReport) write(w io.Writer, format string) error {
+	switch format {
+	case checkFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+
+	case checkFormatJUnit:
+		suite := &junitTestSuite{
+			Name:     "loca links",
+			Tests:    r.Checked,
+			Failures: len(r.Broken),
+		}
+
+		for _, result := range r.all {
+			tc := junitTestCase{
+				ClassName: "links",
+				Name:      result.URL,
+			}
+
+			if parsed, err := url.Parse(result.URL); err == nil {
+				tc.ClassName = parsed.Host
+			}
+
+			if result.broken {
+				tc.Failure = &junitFailure{
+					Message: result.describe(),
+					Type:    "broken",
+					Text:    "linked from:\n" + strings.Join(result.Referrers, "\n"),
+				}
+			}
+
+			suite.Cases = append(suite.Cases, tc)
+		}
+
+		io.WriteString(w, xml.Header)
+
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "  ")
+		if err := enc.Encode(suite); err != nil {
+			return err
+		}
+
+		_, err := io.WriteString(w, "\n")
+		return err
+
+	default:
+		for _, result := range r.Broken {
+			fmt.Fprintln(w, result.describe(), result.URL)
+
+			for _, ref := range result.Referrers {
+				fmt.Fprintln(w, "  <-", ref)
+			}
+		}
+
+		_, err := fmt.Fprintf(w, "%d broken links of %d checked\n",
+			len(r.Broken),
+			r.Checked,
+		)
+		return err
+	}
+}
+
+// writeLinkReport writes the -check-links report to file,
+// or stdout, and returns the number of broken links
+func writeLinkReport(format, file string) (int, error) {
+	report := newLinkReport()
+
+	if file == "" {
+		return len(report.Broken), report.write(os.Stdout, format)
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return 0, fmt.Errorf("writeLinkReport()-> %v", err)
+	}
+
+	err = report.write(f, format)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+
+	return len(report.Broken), err
+}
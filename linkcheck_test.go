@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckLinks(t *testing.T) {
+	external := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/no-head":
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.Write([]byte("ok"))
+		case "/head":
+			if r.Method != http.MethodHead {
+				t.Error("Expected: HEAD", "But Got:", r.Method)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer external.Close()
+
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="/about">about</a> <a href="/missing">x</a>
+				<a href="` + external.URL + `/no-head">a</a>
+				<a href="` + external.URL + `/head">b</a>
+				<a href="` + external.URL + `/gone">c</a>`))
+		case "/about":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="/missing">x</a> <a href="/">home</a>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer site.Close()
+
+	savedEvents, savedPages, savedDelay := events, pages, *delay
+	defer func() {
+		events, pages, *delay, *checkLinks = savedEvents, savedPages, savedDelay, false
+		checked = map[string]*linkResult{}
+	}()
+
+	events = newEventLog(ioutil.Discard)
+	pages = []string{site.URL + "/"}
+	*delay = 0
+	*checkLinks = true
+	checked = map[string]*linkResult{}
+
+	queue := []string{site.URL + "/"}
+	visited := map[string]bool{}
+
+	for len(queue) > 0 {
+		u := queue[0]
+		queue = queue[1:]
+
+		if visited[u] {
+			continue
+		}
+		visited[u] = true
+
+		discovered, err := checkLink(u)
+		if err != nil {
+			t.Error(err)
+		}
+
+		queue = append(queue, discovered...)
+	}
+
+	report := newLinkReport()
+
+	if report.Checked != 6 {
+		t.Error("Expected: 6 checked", "But Got:", report.Checked)
+	}
+
+	broken := map[string]*linkResult{}
+	for _, r := range report.Broken {
+		broken[r.URL] = r
+	}
+
+	if len(broken) != 2 {
+		t.Error("Expected: 2 broken", "But Got:", len(broken))
+	}
+
+	missing := broken[site.URL+"/missing"]
+	if missing == nil || missing.Status != 404 || len(missing.Referrers) != 2 {
+		t.Error("Expected: /missing 404 from 2 pages", "But Got:", missing)
+	}
+
+	if gone := broken[external.URL+"/gone"]; gone == nil || gone.Referrers[0] != site.URL+"/" {
+		t.Error("Expected: /gone from the start page", "But Got:", gone)
+	}
+
+	out := &bytes.Buffer{}
+	report.write(out, checkFormatText)
+	if !strings.Contains(out.String(), "404 Not Found "+site.URL+"/missing\n  <- ") ||
+		!strings.HasSuffix(out.String(), "2 broken links of 6 checked\n") {
+		t.Error("Unexpected text report:", out.String())
+	}
+
+	out.Reset()
+	report.write(out, checkFormatJSON)
+	decoded := &linkReport{}
+	if err := json.Unmarshal(out.Bytes(), decoded); err != nil || len(decoded.Broken) != 2 {
+		t.Error("Unexpected JSON report:", err, out.String())
+	}
+
+	out.Reset()
+	report.write(out, checkFormatJUnit)
+	suite := &junitTestSuite{}
+	if err := xml.Unmarshal(out.Bytes(), suite); err != nil ||
+		suite.Tests != 6 || suite.Failures != 2 || len(suite.Cases) != 6 {
+		t.Error("Unexpected JUnit report:", err, out.String())
+	}
+}
+
+func TestRequestLinkHostDelay(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	savedDelay := *delay
+	defer func() {
+		*delay = savedDelay
+		hostConfigs = map[string]*hostConfig{}
+	}()
+
+	// not to be waited for this host of -config
+	*delay = time.Minute
+	hostConfigs = map[string]*hostConfig{
+		"127.0.0.1": {delay: 0},
+	}
+
+	started := time.Now()
+
+	resp, err := requestLink(http.MethodGet, server.URL+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Error("Expected: the delay of the host", "But Got:", elapsed)
+	}
+}
@@ -1,61 +1,270 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/codermeorg/filo"
 )
 
 var (
 	pages []string
+
+	// subcommands run instead of crawling,
+	// like `loca graph -format dot`
+	subcommands = map[string]func(args []string) error{
+		"graph":  runGraph,
+		"replay": runReplay,
+		"page":   runPage,
+		"mhtml":  runMHTML,
+		"serve":  runServe,
+		"search": runSearch,
+		"diff":   runDiff,
+		"watch":  runWatch,
+		"config": runConfig,
+	}
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				fatal(1, err)
+			}
+			return
+		}
+	}
+
 	// parse flag
-	parseOptions()
+	err := parseOptions(os.Args[1:])
 
 	if *showVersion {
 		printVersion()
 	}
 
-	var err error
+	if err != nil {
+		fatal(1, err)
+	}
+
 	pages, err = getStartPages()
 	if err != nil {
-		exit(1, err)
+		fatal(1, err)
+	}
+
+	run()
+}
+
+// run crawls from the start pages, saving what it fetches
+func run() {
+	var err error
+
+	scopeCredentials(pages)
+
+	// nothing is saved when checking links
+	if !*checkLinks {
+		mirror, err = openManifest(metaPath(manifestName))
+		if err != nil {
+			fatal(1, err)
+		}
+
+		graph, err = openGraph(metaPath(graphName))
+		if err != nil {
+			fatal(1, err)
+		}
+
+		if *warcFile != "" {
+			archive, err = newWARCWriter(*warcFile, int64(warcMaxSize))
+			if err != nil {
+				fatal(1, err)
+			}
+		}
+
+		if *outputFile != "" {
+			output, err = newMirrorOutput(*outputFile, *exportMHTMLs)
+			if err != nil {
+				fatal(1, err)
+			}
+		}
 	}
 
+	started := time.Now()
+
 	stack := filo.NewStringStack()
 
 	for _, page := range pages {
 		stack.Push(page)
+
+		if err := graph.add("", page, edgeStart); err != nil {
+			logError(err)
+		}
 	}
 
 	concurrent := make(chan struct{}, *concurrency)
+	// visited is only touched by this goroutine
+	visited := map[string]bool{}
+	wg := &sync.WaitGroup{}
+	finished := int64(0)
+
+	if *metricsAddr != "" {
+		metrics = newMetricsRegistry()
+		metrics.setGauges(stack.Len, func() int {
+			return len(concurrent)
+		})
+
+		ln, err := serveMetrics(*metricsAddr, metrics)
+		if err != nil {
+			fatal(1, err)
+		}
+		defer ln.Close()
+	}
+
+	var status *progress
+
+	if !*progressDisabled {
+		status = newProgress(os.Stderr, func() crawlCounters {
+			return crawlCounters{
+				queued:   stack.Len(),
+				inFlight: len(concurrent),
+				finished: int(atomic.LoadInt64(&finished)),
+			}
+		})
+
+		events.setStderr(status)
+		status.start()
+	}
 
 	for {
 
 		if stack.Len() == 0 {
-			break
+			// in-flight workers may push more
+			wg.Wait()
+
+			if stack.Len() == 0 {
+				break
+			}
 		}
 
 		url := stack.Pop()
 
-		if url == "" {
+		if url == "" || visited[url] {
 			continue
 		}
 
+		visited[url] = true
+
 		concurrent <- struct{}{}
+		wg.Add(1)
 
 		go func() {
+			defer wg.Done()
 			defer func() { <-concurrent }()
-			// process URL here
-			// dl uri
-			//	if it text/css, text/html (text|application)/javascript; then (discover) URLs -> resolveURLs -> queue them for prefetching -> rewrite external linked-resources to new local urls
-			// else if its text/* discover links
-			//else if its binary check if content allowed to be downloaded
-			// otherwise skip
+			defer atomic.AddInt64(&finished, 1)
+
+			discovered, err := crawl(url)
+			if err != nil {
+				logError(err)
+			}
+
+			for _, u := range discovered {
+				stack.Push(u)
+			}
 
 		}()
 	}
 
+	if status != nil {
+		status.finish()
+		events.setStderr(os.Stderr)
+	}
+
 	// rewrite paths
+	rewriteMirrored(started)
+
+	exportCrawled()
+
+	if mirror != nil && !*searchDisabled {
+		if err := indexMirrored(mirror, metaPath(searchName)); err != nil {
+			logError("indexMirrored()->", err)
+		}
+	}
+
+	if err := mirror.close(); err != nil {
+		fatal(1, err)
+	}
+
+	if err := graph.close(); err != nil {
+		fatal(1, err)
+	}
+
+	if err := archive.close(); err != nil {
+		fatal(1, err)
+	}
+
+	if err := output.close(); err != nil {
+		fatal(1, err)
+	}
+
+	if *saveCookies != "" {
+		if err := cookies.saveFile(*saveCookies); err != nil {
+			fatal(1, err)
+		}
+	}
+
+	events.summary(os.Stderr)
+
+	broken := 0
+
+	if *checkLinks {
+		broken, err = writeLinkReport(*checkFormat, *checkOutput)
+		if err != nil {
+			fatal(1, err)
+		}
+	}
+
+	if err := events.close(); err != nil {
+		fatal(1, err)
+	}
+
+	// let CI fail on broken links
+	if broken > 0 {
+		os.Exit(1)
+	}
+
+}
+
+// crawl fetches URL and discovers the URLs it links to,
+// unchanged pages are re-scanned from their local copy
+func crawl(u string) ([]string, error) {
+	if *checkLinks {
+		return checkLink(u)
+	}
+
+	// pages are saved on their own, nothing more to crawl
+	if *singleFile {
+		return nil, savePage(u)
+	}
+
+	// fetchToFile records its own failures
+	e, err := fetchToFile(u)
+	if err != nil || e == nil {
+		return nil, nil
+	}
+
+	exportLater(e)
+
+	if !isHTML(e.ContentType) {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(mirroredPath(e.File))
+	if err != nil {
+		return nil, err
+	}
+
+	s, _, _ := decodeText(data, e.ContentType)
 
+	return filterDiscovered(e.URL, s), nil
 }
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// metaDir holds loca's own files inside -dir
+	metaDir      = ".loca"
+	manifestName = "manifest.jsonl"
+)
+
+// mirrorEntry is what we know about a mirrored URL
+type mirrorEntry struct {
+	URL          string    `json:"url"`
+	File         string    `json:"file"`
+	ContentType  string    `json:"content_type,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Size         int64     `json:"size"`
+	Fetched      time.Time `json:"fetched"`
+}
+
+// manifest maps URLs to their local files and validators,
+// it's stored as JSON lines, the last line of a URL wins
+// so entries can be appended while crawling
+type manifest struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]*mirrorEntry
+	f       *os.File
+}
+
+var (
+	// mirror is the manifest of the current -dir
+	mirror *manifest
+)
+
+// metaPath gets path of name inside the metadata dir
+func metaPath(name string) string {
+	return filepath.Join(*dir, metaDir, name)
+}
+
+// localPath gets the local file path of URL inside -dir
+func localPath(u string) string {
+	return filepath.Join(*dir, prettyName(u))
+}
+
+// openManifest loads the manifest at p, if any,
+// and opens it for appending new entries
+func openManifest(p string) (*manifest, error) {
+	m := &manifest{
+		path:    p,
+		entries: map[string]*mirrorEntry{},
+	}
+
+	data, err := ioutil.ReadFile(p)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := m.parse(data); err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	m.f, err = os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// parse parses JSON lines data into entries
+func (m *manifest) parse(data []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		e := &mirrorEntry{}
+		if err := json.Unmarshal(line, e); err != nil {
+			// likely a truncated last line
+			// of an interrupted run
+			continue
+		}
+
+		m.entries[e.URL] = e
+	}
+
+	return scanner.Err()
+}
+
+// get gets the entry of URL or nil
+func (m *manifest) get(u string) *mirrorEntry {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.entries[u]
+}
+
+// put stores the entry and appends it to the manifest file
+func (m *manifest) put(e *mirrorEntry) error {
+	if m == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries[e.URL] = e
+
+	_, err = m.f.Write(append(data, '\n'))
+
+	return err
+}
+
+// list gets all entries sorted by URL
+func (m *manifest) list() []*mirrorEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var entries []*mirrorEntry
+	for _, e := range m.entries {
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].URL < entries[j].URL
+	})
+
+	return entries
+}
+
+// close compacts the manifest to one line per URL
+// and closes it
+func (m *manifest) close() error {
+	if m == nil {
+		return nil
+	}
+
+	err := m.f.Close()
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(m.path), tempFilePrefix)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+
+	for _, e := range m.list() {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), m.path)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	tmp, err := ioutil.TempDir("", tempFilePrefix)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(tmp)
+
+	p := filepath.Join(tmp, manifestName)
+
+	m, err := openManifest(p)
+	if err != nil {
+		t.Error("openManifest() ->", err)
+		return
+	}
+
+	entries := []*mirrorEntry{
+		{URL: "https://example.com/", File: "html/example.com/index.html", ETag: `"v1"`},
+		{URL: "https://example.com/logo.png", File: "assets/images/png/example.com/logo.png"},
+		{URL: "https://example.com/", File: "html/example.com/index.html", ETag: `"v2"`},
+	}
+
+	for _, e := range entries {
+		if err := m.put(e); err != nil {
+			t.Error("put() ->", err)
+		}
+	}
+
+	// interrupted run
+	m.f.WriteString(`{"url":"https://example.com/trunc`)
+
+	if err := m.close(); err != nil {
+		t.Error("close() ->", err)
+		return
+	}
+
+	m, err = openManifest(p)
+	if err != nil {
+		t.Error("openManifest() ->", err)
+		return
+	}
+	defer m.f.Close()
+
+	if len(m.entries) != 2 {
+		t.Error("Wrong entries count", len(m.entries))
+	}
+
+	e := m.get("https://example.com/")
+	if e == nil || e.ETag != `"v2"` {
+		t.Error("Expected the last entry to win, But Got:", e)
+	}
+
+}
+
+func TestSetConditional(t *testing.T) {
+	tmp, err := ioutil.TempDir("", tempFilePrefix)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(tmp)
+
+	*dir = tmp
+	defer func() { *dir = defaultDir }()
+
+	e := &mirrorEntry{
+		URL:          "https://example.com/",
+		File:         "index.html",
+		ETag:         `"v1"`,
+		LastModified: "Mon, 02 Jan 2006 15:04:05 GMT",
+	}
+
+	req, _ := http.NewRequest("GET", e.URL, nil)
+	setConditional(req, e)
+
+	if req.Header.Get("If-None-Match") != "" {
+		t.Error("Conditional headers set without a local copy")
+	}
+
+	ioutil.WriteFile(filepath.Join(tmp, e.File), []byte("<html>"), 0666)
+	setConditional(req, e)
+
+	if req.Header.Get("If-None-Match") != e.ETag {
+		t.Error("Expected:", e.ETag, "But Got:", req.Header.Get("If-None-Match"))
+	}
+
+	if req.Header.Get("If-Modified-Since") != e.LastModified {
+		t.Error("Expected:", e.LastModified, "But Got:", req.Header.Get("If-Modified-Since"))
+	}
+
+}
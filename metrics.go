@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// metrics is nil unless -metrics-addr is set
+	metrics *metricsRegistry
+
+	// fetchDurationBuckets are upper bounds in seconds
+	fetchDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+)
+
+// requestKey labels loca_requests_total
+type requestKey struct {
+	status, host string
+}
+
+// metricsRegistry collects crawl metrics from events
+// and exposes them in the Prometheus text format
+type metricsRegistry struct {
+	mu sync.Mutex
+
+	requests   map[requestKey]float64
+	rejections map[string]float64
+	bytes      float64
+	retries    float64
+
+	// fetch latency histogram
+	durationCounts []uint64
+	durationSum    float64
+	durationCount  uint64
+
+	frontier func() int
+	inFlight func() int
+}
+
+// newMetricsRegistry creates an empty registry
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		requests:       map[requestKey]float64{},
+		rejections:     map[string]float64{},
+		durationCounts: make([]uint64, len(fetchDurationBuckets)),
+	}
+}
+
+// setGauges sets the frontier size and in-flight workers sources
+func (m *metricsRegistry) setGauges(frontier, inFlight func() int) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.frontier = frontier
+	m.inFlight = inFlight
+}
+
+// observe updates the metrics from a recorded event
+func (m *metricsRegistry) observe(e *crawlEvent) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e.Status != 0 {
+		host := ""
+		if parsed, err := url.Parse(e.URL); err == nil {
+			host = parsed.Host
+		}
+
+		m.requests[requestKey{strconv.Itoa(e.Status), host}]++
+	}
+
+	switch e.Event {
+	case eventFetched:
+		m.bytes += float64(e.Bytes)
+	case eventRetry:
+		m.retries++
+	case eventRejected:
+		m.rejections[e.Rule]++
+	case eventSkipped:
+		// already mirrored is not a filter
+		if e.Rule != ruleExists {
+			m.rejections[e.Rule]++
+		}
+	}
+
+	// outcomes of fetchToFile carry the fetch duration
+	if e.Duration > 0 {
+		seconds := e.Duration / 1000
+
+		for i, le := range fetchDurationBuckets {
+			if seconds <= le {
+				m.durationCounts[i]++
+			}
+		}
+
+		m.durationSum += seconds
+		m.durationCount++
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeHelp(bw, "loca_requests_total", "counter", "HTTP responses by status and host.")
+	var keys []requestKey
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].host != keys[j].host {
+			return keys[i].host < keys[j].host
+		}
+		return keys[i].status < keys[j].status
+	})
+	for _, k := range keys {
+		fmt.Fprintf(bw, "loca_requests_total{status=%s,host=%s} %v\n",
+			quoteLabel(k.status),
+			quoteLabel(k.host),
+			m.requests[k],
+		)
+	}
+
+	writeHelp(bw, "loca_bytes_total", "counter", "Bytes of saved files.")
+	fmt.Fprintf(bw, "loca_bytes_total %v\n", m.bytes)
+
+	writeHelp(bw, "loca_retries_total", "counter", "Retried fetches.")
+	fmt.Fprintf(bw, "loca_retries_total %v\n", m.retries)
+
+	writeHelp(bw, "loca_filter_rejections_total", "counter", "URLs and contents rejected by filters, by rule.")
+	var rules []string
+	for r := range m.rejections {
+		rules = append(rules, r)
+	}
+	sort.Strings(rules)
+	for _, r := range rules {
+		fmt.Fprintf(bw, "loca_filter_rejections_total{rule=%s} %v\n",
+			quoteLabel(r),
+			m.rejections[r],
+		)
+	}
+
+	if m.frontier != nil {
+		writeHelp(bw, "loca_frontier_size", "gauge", "URLs waiting to be fetched.")
+		fmt.Fprintf(bw, "loca_frontier_size %d\n", m.frontier())
+	}
+
+	if m.inFlight != nil {
+		writeHelp(bw, "loca_in_flight_workers", "gauge", "Workers fetching right now.")
+		fmt.Fprintf(bw, "loca_in_flight_workers %d\n", m.inFlight())
+	}
+
+	writeHelp(bw, "loca_fetch_duration_seconds", "histogram", "Latency of fetching and saving URLs.")
+	for i, le := range fetchDurationBuckets {
+		fmt.Fprintf(bw, "loca_fetch_duration_seconds_bucket{le=\"%v\"} %d\n", le, m.durationCounts[i])
+	}
+	fmt.Fprintf(bw, "loca_fetch_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.durationCount)
+	fmt.Fprintf(bw, "loca_fetch_duration_seconds_sum %v\n", m.durationSum)
+	fmt.Fprintf(bw, "loca_fetch_duration_seconds_count %d\n", m.durationCount)
+}
+
+// writeHelp writes the HELP and TYPE lines of a metric
+func writeHelp(w *bufio.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// quoteLabel quotes a label value
+func quoteLabel(v string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+	return `"` + r.Replace(v) + `"`
+}
+
+// serveMetrics serves /metrics and /debug/pprof/ on addr,
+// it returns once listening
+func serveMetrics(addr string, m *metricsRegistry) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	go func() {
+		err := http.Serve(ln, mux)
+		if err != nil && !strings.Contains(err.Error(), "use of closed") {
+			logError("metrics ->", err)
+		}
+	}()
+
+	return ln, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeMetrics(t *testing.T) {
+	m := newMetricsRegistry()
+	m.setGauges(func() int { return 7 }, func() int { return 2 })
+
+	ln, err := serveMetrics("127.0.0.1:0", m)
+	if err != nil {
+		t.Error("serveMetrics() ->", err)
+		return
+	}
+	defer ln.Close()
+
+	events := []*crawlEvent{
+		{Event: eventFetched, URL: "https://example.com/", Status: 200, Bytes: 1024, Duration: 80},
+		{Event: eventRetry, URL: "https://example.com/a", Status: 503},
+		{Event: eventFailed, URL: "https://example.com/a", Status: 503, Duration: 3000},
+		{Event: eventRejected, URL: "https://example.com/b.pdf", Rule: "-exclude"},
+		{Event: eventSkipped, URL: "https://example.com/", Rule: ruleExists},
+	}
+
+	for _, e := range events {
+		m.observe(e)
+	}
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/metrics")
+	if err != nil {
+		t.Error("scraping /metrics ->", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	data, _ := ioutil.ReadAll(resp.Body)
+	scraped := string(data)
+
+	checks := []string{
+		`loca_requests_total{status="200",host="example.com"} 1`,
+		`loca_requests_total{status="503",host="example.com"} 2`,
+		`loca_bytes_total 1024`,
+		`loca_retries_total 1`,
+		`loca_filter_rejections_total{rule="-exclude"} 1`,
+		`loca_frontier_size 7`,
+		`loca_in_flight_workers 2`,
+		`loca_fetch_duration_seconds_bucket{le="0.1"} 1`,
+		`loca_fetch_duration_seconds_bucket{le="5"} 2`,
+		`loca_fetch_duration_seconds_count 2`,
+	}
+
+	for _, c := range checks {
+		if !strings.Contains(scraped, c) {
+			t.Error("/metrics doesn't contain", c)
+		}
+	}
+
+	if strings.Contains(scraped, `rule="exists"`) {
+		t.Error("/metrics counts mirrored URLs as filter rejections")
+	}
+
+	resp, err = http.Get("http://" + ln.Addr().String() + "/debug/pprof/cmdline")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Error("Expected pprof on the metrics listener, But Got:", err)
+		return
+	}
+	resp.Body.Close()
+
+}
+
+func TestFetchDurationWithoutDelay(t *testing.T) {
+	tmp, err := ioutil.TempDir("", tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	savedDir, savedDelay, savedMetrics := *dir, *delay, metrics
+	defer func() {
+		*dir, *delay, metrics = savedDir, savedDelay, savedMetrics
+	}()
+
+	*dir = tmp
+	*delay = 300 * time.Millisecond
+	metrics = newMetricsRegistry()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("quick"))
+	}))
+	defer server.Close()
+
+	started := time.Now()
+
+	if _, err := fetchToFile(server.URL + "/quick.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Since(started) < *delay {
+		t.Error("Expected: the delay before the request", "But Got:", time.Since(started))
+	}
+
+	if metrics.durationCount != 1 || metrics.durationSum >= delay.Seconds() {
+		t.Error("Expected: a duration without the delay", "But Got:", metrics.durationCount, metrics.durationSum)
+	}
+}
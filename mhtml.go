@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDirMHTML = "mhtml"
+)
+
+var (
+	// exported keeps the HTML pages of the current run for -mhtml
+	exported   []*mirrorEntry
+	exportedMu sync.Mutex
+)
+
+// mhtmlName gets the name of the MHTML file of URL inside -dir-mhtml
+func mhtmlName(u string) string {
+	name := prettyName(u)
+
+	// the pages dir is implied
+	if parts := strings.SplitN(name, "/", 2); len(parts) == 2 {
+		name = parts[1]
+	}
+
+	if name == "" || strings.HasSuffix(name, "/") {
+		name += "index"
+	}
+
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ".mht"
+}
+
+// pageParts gets the mirrored entries of the page and its assets,
+// including the fonts and images of its stylesheets
+func pageParts(page *mirrorEntry, lookup func(string) *mirrorEntry) ([]*mirrorEntry, error) {
+	parts := []*mirrorEntry{page}
+	seen := map[string]bool{page.URL: true}
+
+	for i := 0; i < len(parts); i++ {
+		e := parts[i]
+
+		if !isHTML(e.ContentType) && !isCSS(e.ContentType) {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(mirroredPath(e.File))
+		if err != nil {
+			return nil, err
+		}
+
+		s, _, _ := decodeText(data, e.ContentType)
+
+		var refs []string
+
+		if isHTML(e.ContentType) {
+			refs = discoverAssetsURLs(s)
+
+			for _, m := range reSrcset.FindAllStringSubmatch(s, -1) {
+				for _, c := range strings.Split(m[2], ",") {
+					if fields := strings.Fields(c); len(fields) > 0 {
+						refs = append(refs, fields[0])
+					}
+				}
+			}
+		}
+
+		for _, m := range reCSSURL.FindAllStringSubmatch(s, -1) {
+			refs = append(refs, m[2])
+		}
+
+		for _, ref := range refs {
+			ref = strings.TrimSpace(ref)
+			if ref == "" || strings.HasPrefix(ref, "data:") {
+				continue
+			}
+
+			u, err := resolveURL(e.URL, ref, true)
+			if err != nil || seen[u] {
+				continue
+			}
+
+			seen[u] = true
+
+			// assets that weren't mirrored stay remote
+			if asset := lookup(u); asset != nil {
+				parts = append(parts, asset)
+			}
+		}
+	}
+
+	return parts, nil
+}
+
+// base64Lines wraps base64 at 76 columns as MIME wants
+type base64Lines struct {
+	w   io.Writer
+	col int
+}
+
+// Write writes p broken into lines
+func (l *base64Lines) Write(p []byte) (int, error) {
+	n := 0
+
+	for len(p) > 0 {
+		chunk := 76 - l.col
+		if chunk > len(p) {
+			chunk = len(p)
+		}
+
+		w, err := l.w.Write(p[:chunk])
+		n += w
+		if err != nil {
+			return n, err
+		}
+
+		l.col += chunk
+		p = p[chunk:]
+
+		if l.col == 76 {
+			if _, err := io.WriteString(l.w, "\r\n"); err != nil {
+				return n, err
+			}
+			l.col = 0
+		}
+	}
+
+	return n, nil
+}
+
+// writeMHTML writes the page with its assets as a multipart/related
+// MHTML document, each part has the Content-Location of its URL
+func writeMHTML(w io.Writer, page *mirrorEntry, lookup func(string) *mirrorEntry) error {
+	parts, err := pageParts(page, lookup)
+	if err != nil {
+		return err
+	}
+
+	b := make([]byte, 12)
+	rand.Read(b)
+	boundary := fmt.Sprintf("----MultipartBoundary--%x----", b)
+
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "From: <Saved by loca>\r\n")
+	fmt.Fprintf(bw, "Snapshot-Content-Location: %s\r\n", page.URL)
+	fmt.Fprintf(bw, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", page.URL))
+	fmt.Fprintf(bw, "Date: %s\r\n", page.Fetched.Format(time.RFC1123Z))
+	fmt.Fprintf(bw, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(bw, "Content-Type: multipart/related;\r\n\ttype=\"text/html\";\r\n\tboundary=\"%s\"\r\n\r\n", boundary)
+
+	mw := multipart.NewWriter(bw)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return err
+	}
+
+	for _, e := range parts {
+		contentType := e.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		text := isText(parseMediaType(contentType))
+
+		encoding := "base64"
+		if text {
+			encoding = "quoted-printable"
+		}
+
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Transfer-Encoding": {encoding},
+			"Content-Location":          {e.URL},
+		})
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(mirroredPath(e.File))
+		if err != nil {
+			return err
+		}
+
+		var enc io.WriteCloser
+		if text {
+			enc = quotedprintable.NewWriter(pw)
+		} else {
+			enc = base64.NewEncoder(base64.StdEncoding, &base64Lines{w: pw})
+		}
+
+		_, err = io.Copy(enc, f)
+		f.Close()
+
+		if err != nil {
+			return err
+		}
+
+		if err := enc.Close(); err != nil {
+			return err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// exportMHTML writes the MHTML file of a mirrored page
+func exportMHTML(page *mirrorEntry, lookup func(string) *mirrorEntry) error {
+	name := filepath.Join(*dir, *dirMHTML, mhtmlName(page.URL))
+
+	r, w := io.Pipe()
+
+	go func() {
+		w.CloseWithError(writeMHTML(w, page, lookup))
+	}()
+
+	err := saveFile(r, name)
+	r.Close()
+
+	if err != nil {
+		return fmt.Errorf("Err: exportMHTML(%s) -> %v", page.URL, err)
+	}
+
+	return nil
+}
+
+// exportLater remembers a page crawled in this run for -mhtml
+func exportLater(e *mirrorEntry) {
+	if !*exportMHTMLs || !isHTML(e.ContentType) {
+		return
+	}
+
+	exportedMu.Lock()
+	defer exportedMu.Unlock()
+
+	exported = append(exported, e)
+}
+
+// exportCrawled writes the MHTML files of the pages crawled
+// in this run, once their assets are mirrored
+func exportCrawled() {
+	exportedMu.Lock()
+	defer exportedMu.Unlock()
+
+	for _, e := range exported {
+		if err := exportMHTML(e, mirror.get); err != nil {
+			events.record(&crawlEvent{
+				Event: eventError,
+				URL:   e.URL,
+				Error: err.Error(),
+			})
+		}
+	}
+
+	exported = nil
+}
+
+// runMHTML runs `loca mhtml [URL...]`, exporting mirrored pages,
+// all of them unless URLs are given
+func runMHTML(args []string) error {
+	fs := flag.NewFlagSet("mhtml", flag.ExitOnError)
+	fs.StringVar(dir, "dir", *dir, "Dirctory root of the mirror.")
+	fs.StringVar(dirMHTML, "dir-mhtml", *dirMHTML, "Dirctory where to store MHTML files.")
+	fs.Parse(args)
+
+	m, err := openManifest(metaPath(manifestName))
+	if err != nil {
+		return fmt.Errorf("openManifest()-> %v", err)
+	}
+	defer m.close()
+
+	var entries []*mirrorEntry
+
+	if fs.NArg() == 0 {
+		for _, e := range m.list() {
+			if isHTML(e.ContentType) {
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	for _, u := range fs.Args() {
+		e := m.get(u)
+		if e == nil {
+			return fmt.Errorf("%s is not mirrored in %s", u, *dir)
+		}
+
+		entries = append(entries, e)
+	}
+
+	for _, e := range entries {
+		if err := exportMHTML(e, m.get); err != nil {
+			return err
+		}
+
+		fmt.Println(filepath.Join(*dir, *dirMHTML, mhtmlName(e.URL)))
+	}
+
+	return nil
+}
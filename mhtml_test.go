@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMHTML(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "loca-mhtml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	savedDir := *dir
+	defer func() { *dir = savedDir }()
+	*dir = tmp
+
+	files := map[string][2]string{
+		"https://example.com/docs/":           {"text/html; charset=utf-8", `<link rel="stylesheet" href="site.css"><img src="/logo.png" srcset="/logo@2x.png 2x"><img src="https://cdn.example.com/x.png">`},
+		"https://example.com/docs/site.css":   {"text/css", `body { background: url(bg.png) } p { content: "é=" }`},
+		"https://example.com/logo.png":        {"image/png", strings.Repeat("\x89PNG", 40)},
+		"https://example.com/logo@2x.png":     {"image/png", "PNG2x"},
+		"https://example.com/docs/bg.png":     {"image/png", "BG"},
+		"https://example.com/docs/other.html": {"text/html", "not linked as an asset"},
+	}
+
+	m, err := openManifest(metaPath(manifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.close()
+
+	for u, f := range files {
+		e := &mirrorEntry{URL: u, File: prettyName(u), ContentType: f[0], Fetched: time.Now()}
+
+		os.MkdirAll(filepath.Dir(filepath.Join(tmp, e.File)), 0777)
+		ioutil.WriteFile(filepath.Join(tmp, e.File), []byte(f[1]), 0666)
+		m.put(e)
+	}
+
+	out := &bytes.Buffer{}
+	if err := writeMHTML(out, m.get("https://example.com/docs/"), m.get); err != nil {
+		t.Fatal(err)
+	}
+
+	tp := textproto.NewReader(bufio.NewReader(out))
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if header.Get("Snapshot-Content-Location") != "https://example.com/docs/" {
+		t.Error("Unexpected headers:", header)
+	}
+
+	mt, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || mt != "multipart/related" || params["type"] != "text/html" {
+		t.Error("Unexpected Content-Type:", header.Get("Content-Type"))
+	}
+
+	got := map[string]string{}
+
+	mr := multipart.NewReader(tp.R, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+
+		data, _ := ioutil.ReadAll(p)
+
+		if p.Header.Get("Content-Transfer-Encoding") == "base64" {
+			data, err = base64.StdEncoding.DecodeString(strings.Replace(string(data), "\r\n", "", -1))
+			if err != nil {
+				t.Error(err)
+			}
+		}
+
+		got[p.Header.Get("Content-Location")] = string(data)
+	}
+
+	for u, f := range files {
+		if u == "https://example.com/docs/other.html" {
+			if _, ok := got[u]; ok {
+				t.Error("Expected: only assets of the page", "But Got:", u)
+			}
+			continue
+		}
+
+		if got[u] != f[1] {
+			t.Error("Expected:", f[1], "for", u, "But Got:", got[u])
+		}
+	}
+
+	if len(got) != 5 {
+		t.Error("Expected: 5 parts", "But Got:", len(got))
+	}
+}
+
+func TestMHTMLName(t *testing.T) {
+	tests := map[string]string{
+		"https://example.com/":            "example.com/index.mht",
+		"https://example.com/docs/a.html": "example.com/docs/a.mht",
+	}
+
+	for u, expected := range tests {
+		if got := mhtmlName(u); got != expected {
+			t.Error("Expected:", expected, "But Got:", got)
+		}
+	}
+}
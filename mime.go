@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+var (
+	// errTooLarge is returned by maxSizeReader when
+	// the body grows beyond -max-file-size
+	errTooLarge = errors.New("file exceeds -max-file-size")
+)
+
+// mediaType gets the lowered media type of the response,
+// the HTTP default application/octet-stream is used when missing
+func mediaType(headers http.Header) string {
+	return parseMediaType(headers.Get("Content-Type"))
+}
+
+// parseMediaType gets the lowered media type of a Content-Type value
+func parseMediaType(contentType string) string {
+	if contentType == "" {
+		return "application/octet-stream"
+	}
+
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// fallback to the raw value
+		mt = strings.SplitN(contentType, ";", 2)[0]
+	}
+
+	return strings.ToLower(strings.TrimSpace(mt))
+}
+
+// isHTML checks whether the Content-Type value is a HTML page
+func isHTML(contentType string) bool {
+	mt := parseMediaType(contentType)
+
+	return mt == "text/html" || mt == "application/xhtml+xml"
+}
+
+// matchMIME checks whether the media type mt matches pattern,
+// patterns may use wildcards like image/* or */*
+func matchMIME(pattern, mt string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+
+	if pattern == "*" || pattern == "*/*" || pattern == mt {
+		return true
+	}
+
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mt, strings.TrimSuffix(pattern, "*"))
+	}
+
+	return false
+}
+
+// matchMIMEList checks mt against CSV of patterns,
+// returns the matched pattern
+func matchMIMEList(csv, mt string) (string, bool) {
+	for _, p := range strings.Split(csv, ",") {
+		p = strings.TrimSpace(p)
+
+		if p == "" {
+			continue
+		}
+
+		if matchMIME(p, mt) {
+			return p, true
+		}
+	}
+
+	return "", false
+}
+
+// maxSizeReader fails reading once more than max bytes were read,
+// it guards chunked or lying responses
+type maxSizeReader struct {
+	io.ReadCloser
+	read, max int64
+}
+
+// Read reads from the underlying body and counts the bytes
+func (r *maxSizeReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+
+	if r.read > r.max {
+		return n, errTooLarge
+	}
+
+	return n, err
+}
+
+// limitBody wraps the response body to abort
+// the transfer after -max-file-size, offset is
+// the size we already have of a resumed download
+func limitBody(resp *http.Response, offset int64) {
+	if maxFileSize <= 0 {
+		return
+	}
+
+	resp.Body = &maxSizeReader{
+		ReadCloser: resp.Body,
+		read:       offset,
+		max:        int64(maxFileSize),
+	}
+}
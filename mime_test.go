@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMatchMIME(t *testing.T) {
+	checks := []struct {
+		Pattern,
+		MediaType string
+		Result bool
+	}{
+		{"image/*", "image/png", true},
+		{"image/*", "text/html", false},
+		{"*/*", "text/html", true},
+		{"text/html", "text/html", true},
+		{"Text/HTML", "text/html", true},
+		{"text/css", "text/html", false},
+	}
+
+	for _, c := range checks {
+		result := matchMIME(c.Pattern, c.MediaType)
+		if c.Result != result {
+			t.Error(c.Pattern, c.MediaType, "Expected:", c.Result, "But Got:", result)
+		}
+	}
+
+}
+
+func TestMediaType(t *testing.T) {
+	types := map[string]string{
+		"":                          "application/octet-stream",
+		"text/HTML; charset=UTF-8":  "text/html",
+		"image/png":                 "image/png",
+		"text/css;;charset=invalid": "text/css",
+	}
+
+	for contentType, expected := range types {
+		headers := http.Header{}
+		headers.Set("Content-Type", contentType)
+
+		mt := mediaType(headers)
+		if mt != expected {
+			t.Error("Expected:", expected, "But Got:", mt)
+		}
+	}
+
+}
+
+func TestMaxSizeReader(t *testing.T) {
+	body := ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 100)))
+
+	_, err := ioutil.ReadAll(&maxSizeReader{ReadCloser: body, max: 10})
+	if err != errTooLarge {
+		t.Error("Expected:", errTooLarge, "But Got:", err)
+	}
+
+	body = ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 100)))
+
+	data, err := ioutil.ReadAll(&maxSizeReader{ReadCloser: body, max: 100})
+	if err != nil || len(data) != 100 {
+		t.Error("Expected 100 bytes, But Got:", len(data), err)
+	}
+
+}
+
+func TestParseSize(t *testing.T) {
+	sizes := map[string]int64{
+		"512":  512,
+		"500k": 500 << 10,
+		"2M":   2 << 20,
+		"2MB":  2 << 20,
+		"1.5G": 3 << 29,
+	}
+
+	for v, expected := range sizes {
+		n, err := parseSize(v)
+		if err != nil || n != expected {
+			t.Error(v, "Expected:", expected, "But Got:", n, err)
+		}
+	}
+
+	for _, v := range []string{"", "k", "-1", "2X"} {
+		if _, err := parseSize(v); err == nil {
+			t.Error(v, "is invalid, but got no err")
+		}
+	}
+
+}
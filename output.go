@@ -0,0 +1,688 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	outputZIP    = "zip"
+	outputTar    = "tar"
+	outputTarGz  = "tar.gz"
+	outputTarZst = "tar.zst"
+
+	// spoolDir keeps text files inside metaDir until the
+	// archive is closed, so they can still be read and rewritten
+	spoolDir = "spool"
+
+	// zipMemoryMaxSize is the size of the largest ZIP entries
+	// decompressed in memory to be served, others go to a temp file
+	zipMemoryMaxSize = 1 << 20
+)
+
+var (
+	// output is nil unless mirroring into -output
+	output *mirrorOutput
+)
+
+// outputFormat gets the archive format from the name of the file
+func outputFormat(name string) (string, error) {
+	lower := strings.ToLower(name)
+
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return outputZIP, nil
+	case strings.HasSuffix(lower, ".tar"):
+		return outputTar, nil
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return outputTarGz, nil
+	case strings.HasSuffix(lower, ".tar.zst"), strings.HasSuffix(lower, ".tzst"):
+		return outputTarZst, nil
+	}
+
+	return "", fmt.Errorf("unknown -output format %q, expected .zip, .tar, .tar.gz or .tar.zst", name)
+}
+
+// mirrorOutput writes the mirrored files into a ZIP or tar
+// archive under their -dir relative paths, binary files are
+// streamed as they are saved, text files are kept aside for
+// the rewriting pass and added when closing
+type mirrorOutput struct {
+	mu sync.Mutex
+	f  *os.File
+	zw *zip.Writer
+	tw *tar.Writer
+	// cw compresses the tar stream, if any
+	cw    io.WriteCloser
+	spool string
+	// keepAll spools binary files too, -mhtml reads them back
+	keepAll bool
+	sizes   map[string]int64
+}
+
+// newMirrorOutput creates the archive name
+func newMirrorOutput(name string, keepAll bool) (*mirrorOutput, error) {
+	format, err := outputFormat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	spool := metaPath(spoolDir)
+
+	// leftovers of an interrupted run
+	if err := os.RemoveAll(spool); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(spool, 0777); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &mirrorOutput{
+		f:       f,
+		spool:   spool,
+		keepAll: keepAll,
+		sizes:   map[string]int64{},
+	}
+
+	switch format {
+	case outputZIP:
+		o.zw = zip.NewWriter(f)
+	case outputTar:
+		o.tw = tar.NewWriter(f)
+	case outputTarGz:
+		o.cw = gzip.NewWriter(f)
+		o.tw = tar.NewWriter(o.cw)
+	case outputTarZst:
+		o.cw, err = zstd.NewWriter(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		o.tw = tar.NewWriter(o.cw)
+	}
+
+	return o, nil
+}
+
+// archiveName gets the slash separated path of name inside -dir
+func archiveName(name string) (string, error) {
+	rel, err := filepath.Rel(*dir, name)
+	if err != nil {
+		return "", err
+	}
+
+	rel = filepath.ToSlash(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("Err: %s is outside of %s", name, *dir)
+	}
+
+	return rel, nil
+}
+
+// isTextFile sniffs whether the file at p is text
+func isTextFile(p string) bool {
+	f, err := os.Open(p)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+
+	mt := parseMediaType(http.DetectContentType(head[:n]))
+
+	return strings.HasPrefix(mt, "text/") || isText(mt)
+}
+
+// add moves the finished file tmp into the archive as name
+func (o *mirrorOutput) add(name, tmp string) error {
+	rel, err := archiveName(name)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(tmp)
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	o.sizes[name] = fi.Size()
+	o.mu.Unlock()
+
+	if o.keepAll || isTextFile(tmp) {
+		p := filepath.Join(o.spool, filepath.FromSlash(rel))
+
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			return err
+		}
+
+		return os.Rename(tmp, p)
+	}
+
+	f, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	err = o.write(rel, f, fi.Size(), fi.ModTime())
+	o.mu.Unlock()
+
+	f.Close()
+
+	if e := os.Remove(tmp); err == nil {
+		err = e
+	}
+
+	return err
+}
+
+// write writes an archive entry, o.mu must be held
+func (o *mirrorOutput) write(rel string, r io.Reader, size int64, modTime time.Time) error {
+	if o.zw != nil {
+		w, err := o.zw.CreateHeader(&zip.FileHeader{
+			Name:     rel,
+			Method:   zip.Deflate,
+			Modified: modTime,
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(w, r)
+		return err
+	}
+
+	err := o.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     rel,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(o.tw, r)
+
+	return err
+}
+
+// size gets the size of the file saved as name
+func (o *mirrorOutput) size(name string) (int64, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	n, ok := o.sizes[name]
+
+	return n, ok
+}
+
+// addFile adds the file at p to the archive as rel
+func (o *mirrorOutput) addFile(rel, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.write(rel, f, fi.Size(), fi.ModTime())
+}
+
+// close adds the spooled files and the manifest, in order,
+// then closes the archive
+func (o *mirrorOutput) close() error {
+	if o == nil {
+		return nil
+	}
+
+	var names []string
+
+	err := filepath.Walk(o.spool, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.Mode().IsRegular() {
+			names = append(names, p)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(names)
+
+	for _, p := range names {
+		rel, err := filepath.Rel(o.spool, p)
+		if err != nil {
+			return err
+		}
+
+		if err := o.addFile(filepath.ToSlash(rel), p); err != nil {
+			return err
+		}
+	}
+
+	// the manifest lets `loca serve` map URLs to entries
+	// and search them
+	for _, name := range []string{manifestName, searchName} {
+		err = o.addFile(path.Join(metaDir, name), metaPath(name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if o.zw != nil {
+		err = o.zw.Close()
+	} else {
+		err = o.tw.Close()
+	}
+
+	if o.cw != nil {
+		if e := o.cw.Close(); err == nil {
+			err = e
+		}
+	}
+
+	if e := o.f.Close(); err == nil {
+		err = e
+	}
+
+	if e := os.RemoveAll(o.spool); err == nil {
+		err = e
+	}
+
+	return err
+}
+
+// placeFile moves the finished file tmp to name inside -dir,
+// or into the -output archive, sum is the SHA-256 of its body
+// or nil when it's yet to be computed
+func placeFile(tmp, name string, sum []byte) error {
+	if output != nil {
+		return output.add(name, tmp)
+	}
+
+	if !*dedupDisabled {
+		return storeFile(tmp, name, sum)
+	}
+
+	err := os.MkdirAll(filepath.Dir(name), 0777)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, name)
+}
+
+// savedSize gets the size of the file saved as name
+func savedSize(name string) (int64, error) {
+	if output != nil {
+		if n, ok := output.size(name); ok {
+			return n, nil
+		}
+	}
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+
+	return fi.Size(), nil
+}
+
+// mirroredPath gets where the file of an entry can be read back,
+// binary files streamed into -output can't
+func mirroredPath(file string) string {
+	if output != nil {
+		return filepath.Join(output.spool, file)
+	}
+
+	return filepath.Join(*dir, file)
+}
+
+// rewriteMirrored rewrites the HTML pages fetched since started
+// for offline browsing, inside -dir or before they go into -output
+func rewriteMirrored(started time.Time) {
+	if mirror == nil || *offlineDisabled || len(hosts) == 0 {
+		return
+	}
+
+	for _, e := range mirror.list() {
+		if !isHTML(e.ContentType) || e.Fetched.Before(started) {
+			continue
+		}
+
+		p := mirroredPath(e.File)
+
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			continue
+		}
+
+		rewritten := rewriteOfflineURLs(string(data))
+		if rewritten == string(data) {
+			continue
+		}
+
+		// a new file, the stored body may be shared
+		if err := saveFile(strings.NewReader(rewritten), filepath.Join(*dir, e.File)); err != nil {
+			logError(err)
+		}
+	}
+}
+
+// mirrorFile is an entry of an archived mirror
+type mirrorFile struct {
+	offset  int64
+	size    int64
+	modTime time.Time
+	zf      *zip.File
+}
+
+// mirrorReader reads the files of a mirror from its -dir
+// or from an -output archive
+type mirrorReader struct {
+	root  string
+	zr    *zip.ReadCloser
+	f     *os.File
+	files map[string]*mirrorFile
+	// tmp is the decompressed tar, if any
+	tmp string
+}
+
+// openMirrorReader opens the mirror at p, a directory or an archive,
+// compressed tar archives are decompressed to a temp file first
+func openMirrorReader(p string) (*mirrorReader, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		return &mirrorReader{root: p}, nil
+	}
+
+	format, err := outputFormat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &mirrorReader{files: map[string]*mirrorFile{}}
+
+	if format == outputZIP {
+		r.zr, err = zip.OpenReader(p)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, zf := range r.zr.File {
+			r.files[zf.Name] = &mirrorFile{
+				size:    int64(zf.UncompressedSize64),
+				modTime: zf.Modified,
+				zf:      zf,
+			}
+		}
+
+		return r, nil
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if format != outputTar {
+		r.f, err = decompressTar(f, format)
+		f.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		r.tmp = r.f.Name()
+	} else {
+		r.f = f
+	}
+
+	tr := tar.NewReader(r.f)
+
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			r.close()
+			return nil, err
+		}
+
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		offset, err := r.f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			r.close()
+			return nil, err
+		}
+
+		r.files[h.Name] = &mirrorFile{
+			offset:  offset,
+			size:    h.Size,
+			modTime: h.ModTime,
+		}
+	}
+
+	return r, nil
+}
+
+// decompressTar decompresses the tar stream of f to a temp file
+func decompressTar(f *os.File, format string) (*os.File, error) {
+	var src io.Reader
+
+	switch format {
+	case outputTarGz:
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+
+		src = gz
+	case outputTarZst:
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+
+		src = zr
+	}
+
+	tmp, err := ioutil.TempFile("", tempFilePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.Copy(tmp, src)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	return tmp, nil
+}
+
+// open opens the file name, a slash separated path
+// inside the mirror, to be closed after reading
+func (r *mirrorReader) open(name string) (io.ReadSeekCloser, time.Time, error) {
+	if r.root != "" {
+		f, err := os.Open(filepath.Join(r.root, filepath.FromSlash(path.Clean("/"+name))))
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+
+		fi, err := f.Stat()
+		if err == nil && fi.IsDir() {
+			err = os.ErrNotExist
+		}
+
+		if err != nil {
+			f.Close()
+			return nil, time.Time{}, err
+		}
+
+		return f, fi.ModTime(), nil
+	}
+
+	mf, ok := r.files[strings.TrimPrefix(path.Clean("/"+name), "/")]
+	if !ok {
+		return nil, time.Time{}, os.ErrNotExist
+	}
+
+	if mf.zf != nil {
+		f, err := openZIPFile(mf.zf)
+		return f, mf.modTime, err
+	}
+
+	return nopCloser{io.NewSectionReader(r.f, mf.offset, mf.size)}, mf.modTime, nil
+}
+
+// nopCloser is a ReadSeeker with nothing to close
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+// Close does nothing
+func (nopCloser) Close() error {
+	return nil
+}
+
+// tempFile is a temp file removed once closed
+type tempFile struct {
+	*os.File
+}
+
+// Close closes and removes the file
+func (f tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// openZIPFile decompresses a ZIP entry to be seeked, small ones
+// in memory and others to a temp file
+func openZIPFile(zf *zip.File) (io.ReadSeekCloser, error) {
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	if zf.UncompressedSize64 <= zipMemoryMaxSize {
+		data, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return nil, err
+		}
+
+		return nopCloser{bytes.NewReader(data)}, nil
+	}
+
+	tmp, err := ioutil.TempFile("", tempFilePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.Copy(tmp, rc)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		tempFile{tmp}.Close()
+		return nil, err
+	}
+
+	return tempFile{tmp}, nil
+}
+
+// manifest loads the manifest of the mirror
+func (r *mirrorReader) manifest() (*manifest, error) {
+	m := &manifest{entries: map[string]*mirrorEntry{}}
+
+	f, _, err := r.open(path.Join(metaDir, manifestName))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, m.parse(data)
+}
+
+// close closes the archive
+func (r *mirrorReader) close() error {
+	var err error
+
+	if r.zr != nil {
+		err = r.zr.Close()
+	}
+
+	if r.f != nil {
+		err = r.f.Close()
+	}
+
+	if r.tmp != "" {
+		os.Remove(r.tmp)
+	}
+
+	return err
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOutputFormat(t *testing.T) {
+	tests := map[string]string{
+		"mirror.zip":     outputZIP,
+		"mirror.tar":     outputTar,
+		"mirror.TGZ":     outputTarGz,
+		"mirror.tar.gz":  outputTarGz,
+		"mirror.tar.zst": outputTarZst,
+	}
+
+	for name, expected := range tests {
+		if got, err := outputFormat(name); got != expected || err != nil {
+			t.Error("Expected:", expected, "But Got:", got, err)
+		}
+	}
+
+	if _, err := outputFormat("mirror.rar"); err == nil {
+		t.Error("Expected: error", "But Got:", err)
+	}
+}
+
+func TestMirrorOutput(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "loca-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	oldDir, oldOutput := *dir, output
+	defer func() {
+		*dir, output = oldDir, oldOutput
+	}()
+
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+
+	for _, name := range []string{"mirror.zip", "mirror.tar.zst"} {
+		*dir = filepath.Join(tmp, strings.Replace(name, ".", "-", -1))
+
+		output, err = newMirrorOutput(filepath.Join(tmp, name), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		page := filepath.Join(*dir, "pages", "example.com", "index.html")
+
+		err = saveFile(strings.NewReader("<p>hello</p>"), page)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = saveFile(strings.NewReader(png), filepath.Join(*dir, "assets", "logo.png"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(page); !os.IsNotExist(err) {
+			t.Error("Expected: nothing saved in -dir", "But Got:", err)
+		}
+
+		// text files can still be read back and rewritten
+		data, err := ioutil.ReadFile(mirroredPath("pages/example.com/index.html"))
+		if string(data) != "<p>hello</p>" {
+			t.Error("Expected: <p>hello</p>", "But Got:", string(data), err)
+		}
+
+		if size, _ := savedSize(page); size != 12 {
+			t.Error("Expected: 12", "But Got:", size)
+		}
+
+		err = ioutil.WriteFile(mirroredPath("pages/example.com/index.html"), []byte("<p>rewritten</p>"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := output.close(); err != nil {
+			t.Fatal(err)
+		}
+		output = nil
+
+		r, err := openMirrorReader(filepath.Join(tmp, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tests := map[string]string{
+			"pages/example.com/index.html": "<p>rewritten</p>",
+			"assets/logo.png":              png,
+		}
+
+		for p, expected := range tests {
+			f, _, err := r.open(p)
+			if err != nil {
+				t.Error("Expected:", p, "But Got:", err)
+				continue
+			}
+
+			data, _ := ioutil.ReadAll(f)
+			f.Close()
+
+			if string(data) != expected {
+				t.Error("Expected:", expected, "But Got:", string(data))
+			}
+		}
+
+		if _, _, err := r.open("missing.html"); !os.IsNotExist(err) {
+			t.Error("Expected:", os.ErrNotExist, "But Got:", err)
+		}
+
+		r.close()
+	}
+}
+
+func TestOpenLargeZIPFile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "loca-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	p := filepath.Join(tmp, "mirror.zip")
+
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	video := strings.Repeat("frame ", zipMemoryMaxSize/3)
+
+	zw := zip.NewWriter(f)
+	w, _ := zw.Create("media/videos/mp4/clip.mp4")
+	w.Write([]byte(video))
+	zw.Close()
+	f.Close()
+
+	r, err := openMirrorReader(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+
+	rc, _, err := r.open("media/videos/mp4/clip.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// decompressed to a temp file, not in memory
+	spooled, ok := rc.(tempFile)
+	if !ok {
+		t.Fatalf("Expected: a temp file But Got: %T", rc)
+	}
+
+	rc.Seek(int64(len(video))-6, io.SeekStart)
+
+	data, _ := ioutil.ReadAll(rc)
+	if string(data) != "frame " {
+		t.Error("Expected: frame", "But Got:", string(data))
+	}
+
+	rc.Close()
+
+	if _, err := os.Stat(spooled.Name()); !os.IsNotExist(err) {
+		t.Error("Expected: the temp file removed", "But Got:", err)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	progressRefresh  = 500 * time.Millisecond
+	progressInterval = 10 * time.Second
+	// clearLine moves to the line start and clears it
+	clearLine = "\r\033[K"
+)
+
+// crawlCounters are what the status line shows
+type crawlCounters struct {
+	queued, inFlight, finished int
+}
+
+// progress shows the crawl status on stderr, as a refreshing
+// line on terminals or as periodic log lines otherwise
+type progress struct {
+	mu  sync.Mutex
+	w   io.Writer
+	tty bool
+	// json logs progress lines as JSON, like the events
+	json bool
+	// line is the status line currently shown
+	line string
+
+	counters func() crawlCounters
+
+	started   time.Time
+	lastBytes int64
+	lastTime  time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// isTerminal checks whether f is a terminal
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// newProgress creates a progress display writing to f
+func newProgress(f *os.File, counters func() crawlCounters) *progress {
+	now := time.Now()
+
+	return &progress{
+		w:        f,
+		tty:      isTerminal(f),
+		json:     events.json,
+		counters: counters,
+		started:  now,
+		lastTime: now,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// start refreshes the display until finish is called
+func (p *progress) start() {
+	interval := progressInterval
+	if p.tty {
+		interval = progressRefresh
+	}
+
+	go func() {
+		defer close(p.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				p.refresh()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// finish stops refreshing and clears the status line
+func (p *progress) finish() {
+	close(p.stop)
+	<-p.done
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.tty && p.line != "" {
+		io.WriteString(p.w, clearLine)
+		p.line = ""
+	}
+}
+
+// refresh redraws the status line or logs it
+func (p *progress) refresh() {
+	counts, bytes := events.snapshot()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	stats := p.stats(p.counters(), counts, bytes, now)
+
+	p.lastBytes = bytes
+	p.lastTime = now
+
+	if p.tty {
+		p.line = stats.String()
+		io.WriteString(p.w, clearLine+p.line)
+		return
+	}
+
+	// a line among the JSON events
+	if p.json {
+		data, _ := json.Marshal(stats)
+		p.w.Write(append(data, '\n'))
+		return
+	}
+
+	fmt.Fprintln(p.w, now.Format("2006/01/02 15:04:05"), "progress", stats)
+}
+
+// progressStats are the numbers shown by the status line
+type progressStats struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Queued   int       `json:"queued"`
+	InFlight int       `json:"in_flight"`
+	Done     int       `json:"done"`
+	Failed   int       `json:"failed"`
+	Skipped  int       `json:"skipped"`
+	Bytes    int64     `json:"bytes"`
+	Rate     int64     `json:"bytes_per_second"`
+	ETA      string    `json:"eta,omitempty"`
+}
+
+// stats computes the numbers of the status line
+func (p *progress) stats(c crawlCounters, counts map[string]int, bytes int64, now time.Time) *progressStats {
+	rate := float64(0)
+	if elapsed := now.Sub(p.lastTime).Seconds(); elapsed > 0 {
+		rate = float64(bytes-p.lastBytes) / elapsed
+	}
+
+	eta := ""
+	if elapsed := now.Sub(p.started).Seconds(); c.finished > 0 && elapsed > 0 {
+		perSecond := float64(c.finished) / elapsed
+		left := time.Duration(float64(c.queued+c.inFlight) / perSecond * float64(time.Second))
+		eta = left.Round(time.Second).String()
+	}
+
+	return &progressStats{
+		Time:     now,
+		Event:    "progress",
+		Queued:   c.queued,
+		InFlight: c.inFlight,
+		Done:     counts[eventFetched] + counts[eventUnchanged] + counts[eventChecked],
+		Failed:   counts[eventFailed] + counts[eventBroken],
+		Skipped:  counts[eventSkipped] + counts[eventRejected],
+		Bytes:    bytes,
+		Rate:     int64(rate),
+		ETA:      eta,
+	}
+}
+
+// String formats the stats as a status line
+func (s *progressStats) String() string {
+	eta := s.ETA
+	if eta == "" {
+		eta = "-"
+	}
+
+	return strings.Join([]string{
+		fmt.Sprintf("queued %d", s.Queued),
+		fmt.Sprintf("in-flight %d", s.InFlight),
+		fmt.Sprintf("done %d", s.Done),
+		fmt.Sprintf("failed %d", s.Failed),
+		fmt.Sprintf("skipped %d", s.Skipped),
+		formatSize(s.Bytes),
+		formatSize(s.Rate) + "/s",
+		"ETA " + eta,
+	}, " | ")
+}
+
+// countedBody counts the bytes of a body as they are read
+type countedBody struct {
+	io.ReadCloser
+}
+
+// Read reads from the body and counts the bytes
+func (c countedBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if n > 0 {
+		events.read(n)
+	}
+
+	return n, err
+}
+
+// countBody counts the body of resp to the received bytes
+func countBody(resp *http.Response) {
+	resp.Body = countedBody{resp.Body}
+}
+
+// Write writes log lines above the status line,
+// so it can be used as the events stderr
+func (p *progress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.tty || p.line == "" {
+		return p.w.Write(b)
+	}
+
+	io.WriteString(p.w, clearLine)
+	n, err := p.w.Write(b)
+	io.WriteString(p.w, p.line)
+
+	return n, err
+}
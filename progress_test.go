@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressStatus(t *testing.T) {
+	now := time.Now()
+
+	p := &progress{
+		started:   now.Add(-10 * time.Second),
+		lastTime:  now.Add(-time.Second),
+		lastBytes: 1 << 20,
+	}
+
+	counts := map[string]int{
+		eventFetched:   8,
+		eventUnchanged: 2,
+		eventFailed:    1,
+		eventSkipped:   3,
+	}
+
+	status := p.stats(crawlCounters{queued: 18, inFlight: 2, finished: 10}, counts, 3<<20, now).String()
+
+	checks := []string{
+		"queued 18", "in-flight 2", "done 10", "failed 1",
+		"skipped 3", "3M", "2M/s", "ETA 20s",
+	}
+
+	for _, c := range checks {
+		if !strings.Contains(status, c) {
+			t.Error(status, "doesn't contain", c)
+		}
+	}
+
+}
+
+func TestProgressWrite(t *testing.T) {
+	buff := &bytes.Buffer{}
+
+	p := &progress{
+		w:    buff,
+		tty:  true,
+		line: "queued 1",
+	}
+
+	p.Write([]byte("failed https://example.com/\n"))
+
+	expected := clearLine + "failed https://example.com/\n" + "queued 1"
+	if buff.String() != expected {
+		t.Errorf("Expected: %q But Got: %q", expected, buff.String())
+	}
+
+}
+
+func TestProgressJSON(t *testing.T) {
+	savedEvents := events
+	defer func() {
+		events = savedEvents
+	}()
+
+	events = newEventLog(&bytes.Buffer{})
+
+	// bytes are counted as they are read, before the file is done
+	resp := &http.Response{
+		Body: ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 2048))),
+	}
+	countBody(resp)
+
+	buf := make([]byte, 1024)
+	resp.Body.Read(buf)
+
+	buff := &bytes.Buffer{}
+
+	p := &progress{
+		w:        buff,
+		json:     true,
+		started:  time.Now(),
+		lastTime: time.Now(),
+		counters: func() crawlCounters {
+			return crawlCounters{queued: 3, inFlight: 1}
+		},
+	}
+
+	p.refresh()
+
+	stats := &progressStats{}
+	if err := json.Unmarshal(buff.Bytes(), stats); err != nil {
+		t.Fatal("Expected: a JSON line", "But Got:", buff.String(), err)
+	}
+
+	if stats.Event != "progress" || stats.Queued != 3 || stats.Bytes != 1024 {
+		t.Error("Expected: progress of 3 queued and 1024 bytes", "But Got:", buff.String())
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// minBurst keeps reads of slow limits reasonably sized
+	minBurst = 4 << 10
+)
+
+var (
+	// globalBucket limits all workers together, nil means unlimited
+	globalBucket *bucket
+
+	hostBucketsMu sync.Mutex
+	hostBuckets   = map[string]*bucket{}
+)
+
+// bucket is a token bucket of bytes per second shared by workers,
+// waiters queue up by reserving tokens ahead, so each gets its turn
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newBucket creates a bucket of rate bytes per second
+// allowing bursts of a tenth of a second
+func newBucket(rate int64) *bucket {
+	burst := float64(rate) / 10
+	if burst < minBurst {
+		burst = minBurst
+	}
+
+	return &bucket{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n tokens and tells how long to wait for them
+func (b *bucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// chunk gets the largest read allowed at once
+func (b *bucket) chunk() int {
+	return int(b.burst)
+}
+
+// hostBucket gets the bucket of host when -limit-rate-host is set
+func hostBucket(host string) *bucket {
+	if limitRateHost <= 0 {
+		return nil
+	}
+
+	host = strings.ToLower(host)
+
+	hostBucketsMu.Lock()
+	defer hostBucketsMu.Unlock()
+
+	b, ok := hostBuckets[host]
+	if !ok {
+		b = newBucket(int64(limitRateHost))
+		hostBuckets[host] = b
+	}
+
+	return b
+}
+
+// throttledBody limits reading of the body by its buckets
+type throttledBody struct {
+	io.ReadCloser
+	buckets []*bucket
+}
+
+// Read reads at most a chunk, then waits for the buckets
+func (t *throttledBody) Read(p []byte) (int, error) {
+	for _, b := range t.buckets {
+		if len(p) > b.chunk() {
+			p = p[:b.chunk()]
+		}
+	}
+
+	n, err := t.ReadCloser.Read(p)
+
+	if n > 0 {
+		var wait time.Duration
+		for _, b := range t.buckets {
+			if w := b.reserve(n); w > wait {
+				wait = w
+			}
+		}
+
+		time.Sleep(wait)
+	}
+
+	return n, err
+}
+
+// throttle limits the response body by -limit-rate and -limit-rate-host
+func throttle(resp *http.Response) {
+	var buckets []*bucket
+
+	if globalBucket != nil {
+		buckets = append(buckets, globalBucket)
+	}
+
+	if resp.Request != nil {
+		if b := hostBucket(resp.Request.URL.Host); b != nil {
+			buckets = append(buckets, b)
+		}
+	}
+
+	if len(buckets) == 0 {
+		return
+	}
+
+	resp.Body = &throttledBody{
+		ReadCloser: resp.Body,
+		buckets:    buckets,
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBucketReserve(t *testing.T) {
+	b := newBucket(100 << 10)
+
+	if w := b.reserve(b.chunk()); w != 0 {
+		t.Error("Expected the burst without waiting, But Got:", w)
+	}
+
+	// a second worth of tokens in debt
+	w := b.reserve(100 << 10)
+	if w < 900*time.Millisecond || w > 1100*time.Millisecond {
+		t.Error("Expected waiting about 1s, But Got:", w)
+	}
+
+}
+
+func TestThrottle(t *testing.T) {
+	globalBucket = newBucket(1 << 20)
+	defer func() { globalBucket = nil }()
+
+	const (
+		workers = 4
+		size    = 100 << 10
+	)
+
+	start := time.Now()
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			resp := &http.Response{
+				Body:    ioutil.NopCloser(strings.NewReader(strings.Repeat("x", size))),
+				Request: &http.Request{URL: &url.URL{Host: "example.com"}},
+			}
+
+			throttle(resp)
+			ioutil.ReadAll(resp.Body)
+		}()
+	}
+
+	wg.Wait()
+
+	// 400k at 1M/s minus the burst
+	elapsed := time.Since(start)
+	if elapsed < 250*time.Millisecond {
+		t.Error("Expected the shared limit to hold, But took:", elapsed)
+	}
+
+}
@@ -34,4 +34,18 @@ var (
 	}
 
 	reWhitespace = regexp.MustCompile(`(?s)\s+`)
+
+	// <meta charset="x"> and <meta http-equiv="Content-Type" content="text/html; charset=x">
+	reMetaCharset = regexp.MustCompile(`(?is)(<meta\s[^<>]*?charset\s*=\s*["']?)([\w:.-]+)`)
+	reHead        = regexp.MustCompile(`(?i)<head(\s[^<>]*)?>`)
+	reCSSCharset  = regexp.MustCompile(`(?i)^@charset\s+["'][^"']*["']\s*;`)
+
+	// assets inlined by -single-file
+	reLinkTag    = regexp.MustCompile(`(?is)<link\s[^<>]*>`)
+	reStylesheet = regexp.MustCompile(`(?i)\srel=["']?stylesheet["'\s>]`)
+	reHREFAttr   = regexp.MustCompile(`(?i)(\shref=["'])([^<>"']+)(["'])`)
+	reScriptSrc  = regexp.MustCompile(`(?is)<script([^<>]*?)\ssrc=["']([^<>"']+)["']([^<>]*)>\s*</script>`)
+	reSrcAttr    = regexp.MustCompile(`(?i)(\ssrc=["'])([^<>"']+)(["'])`)
+	reSrcset     = regexp.MustCompile(`(?i)(\ssrcset=["'])([^<>"']+)(["'])`)
+	reCSSURL     = regexp.MustCompile(`(?i)url\(\s*(['"]?)([^'"()]+)(['"]?)\s*\)`)
 )
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	// replaying is set by `loca replay`, every request is then
+	// answered by replayed, the offline list included
+	replaying bool
+	replayed  *warcArchive
+)
+
+// warcRecord is a record header and where to read it again
+type warcRecord struct {
+	file   string
+	offset int64
+	header textproto.MIMEHeader
+}
+
+// countingReader counts the bytes read, reading bytes one by one
+// keeps gzip from reading past the end of a member
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+// Read reads from the underlying reader
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ReadByte reads a byte from the underlying reader
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// readRecordHeader reads the version line and named fields of a record
+func readRecordHeader(br *bufio.Reader) (textproto.MIMEHeader, error) {
+	tp := textproto.NewReader(br)
+
+	line, err := tp.ReadLine()
+	// records are separated by blank lines
+	for err == nil && line == "" {
+		line, err = tp.ReadLine()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(line, "WARC/") {
+		return nil, fmt.Errorf("invalid WARC record %q", line)
+	}
+
+	return tp.ReadMIMEHeader()
+}
+
+// recordLength gets the Content-Length of a record block
+func recordLength(h textproto.MIMEHeader) (int64, error) {
+	n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid WARC Content-Length %q", h.Get("Content-Length"))
+	}
+
+	return n, nil
+}
+
+// scanWARC reads the record headers of a WARC file,
+// compressed per record when its name ends with .gz
+func scanWARC(name string) ([]*warcRecord, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cr := &countingReader{r: bufio.NewReader(f)}
+
+	var records []*warcRecord
+
+	if !strings.HasSuffix(name, ".gz") {
+		br := bufio.NewReader(cr)
+
+		for {
+			// records are separated by blank lines
+			for {
+				b, err := br.Peek(1)
+				if err != nil || (b[0] != '\r' && b[0] != '\n') {
+					break
+				}
+				br.Discard(1)
+			}
+
+			offset := cr.n - int64(br.Buffered())
+
+			h, err := readRecordHeader(br)
+			if err == io.EOF {
+				return records, nil
+			}
+			if err != nil {
+				return records, fmt.Errorf("%s at %d: %v", name, offset, err)
+			}
+
+			n, err := recordLength(h)
+			if err != nil {
+				return records, fmt.Errorf("%s at %d: %v", name, offset, err)
+			}
+
+			if _, err := br.Discard(int(n)); err != nil {
+				return records, fmt.Errorf("%s at %d: %v", name, offset, err)
+			}
+
+			records = append(records, &warcRecord{name, offset, h})
+		}
+	}
+
+	gz := &gzip.Reader{}
+
+	for {
+		offset := cr.n
+
+		err := gz.Reset(cr)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, fmt.Errorf("%s at %d: %v", name, offset, err)
+		}
+
+		// a record per member
+		gz.Multistream(false)
+
+		h, err := readRecordHeader(bufio.NewReader(gz))
+		if err != nil {
+			return records, fmt.Errorf("%s at %d: %v", name, offset, err)
+		}
+
+		// the rest of the member
+		if _, err := io.Copy(ioutil.Discard, gz); err != nil {
+			return records, fmt.Errorf("%s at %d: %v", name, offset, err)
+		}
+
+		records = append(records, &warcRecord{name, offset, h})
+	}
+}
+
+// recordBody is a record block, closing its file once read
+type recordBody struct {
+	io.Reader
+	f *os.File
+}
+
+// Close closes the WARC file
+func (b *recordBody) Close() error {
+	return b.f.Close()
+}
+
+// open opens the block of the record
+func (r *warcRecord) open() (io.ReadCloser, error) {
+	f, err := os.Open(r.file)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = f.Seek(r.offset, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	var src io.Reader = f
+
+	if strings.HasSuffix(r.file, ".gz") {
+		gz, err := gzip.NewReader(bufio.NewReader(f))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		gz.Multistream(false)
+		src = gz
+	}
+
+	br := bufio.NewReader(src)
+
+	h, err := readRecordHeader(br)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	n, err := recordLength(h)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &recordBody{io.LimitReader(br, n), f}, nil
+}
+
+// response reads the archived response of the record to req
+func (r *warcRecord) response(req *http.Request) (*http.Response, error) {
+	block, err := r.open()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(block), req)
+	if err != nil {
+		block.Close()
+		return nil, err
+	}
+
+	resp.Body = &recordBody{resp.Body, block.(*recordBody).f}
+
+	return resp, nil
+}
+
+// warcArchive answers requests with the responses archived
+// in WARC files, so replaying goes through the same pipeline
+// as live fetches
+type warcArchive struct {
+	// captures maps URLs to their latest response or revisit
+	captures map[string]*warcRecord
+	// responses maps URLs and dates to their response records,
+	// revisits refer to them
+	responses map[string]*warcRecord
+	// starts are the first URLs of each WARC file,
+	// the start pages of the recorded crawls
+	starts []string
+}
+
+// openWARCArchive indexes the records of the WARC files
+func openWARCArchive(names []string) (*warcArchive, error) {
+	a := &warcArchive{
+		captures:  map[string]*warcRecord{},
+		responses: map[string]*warcRecord{},
+	}
+
+	for _, name := range names {
+		records, err := scanWARC(name)
+		if err != nil {
+			return nil, fmt.Errorf("scanWARC()-> %v", err)
+		}
+
+		started := false
+
+		for _, r := range records {
+			u := r.header.Get("WARC-Target-URI")
+
+			switch r.header.Get("WARC-Type") {
+			case "response":
+				a.responses[u+" "+r.header.Get("WARC-Date")] = r
+				a.responses[u] = r
+			case "revisit":
+				// not modified, the previous capture still holds
+				if r.header.Get("WARC-Profile") != warcProfileIdentical {
+					continue
+				}
+			default:
+				continue
+			}
+
+			if !started {
+				a.starts = append(a.starts, u)
+				started = true
+			}
+
+			a.captures[u] = r
+		}
+	}
+
+	return a, nil
+}
+
+// startPages gets the start pages of the recorded crawls,
+// without duplicates
+func (a *warcArchive) startPages() []string {
+	var pages []string
+	seen := map[string]bool{}
+
+	for _, u := range a.starts {
+		if !seen[u] {
+			seen[u] = true
+			pages = append(pages, u)
+		}
+	}
+
+	return pages
+}
+
+// RoundTrip answers req from the archive
+func (a *warcArchive) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := req.URL.String()
+
+	r, ok := a.captures[u]
+	if !ok {
+		return nil, fmt.Errorf("Err: %s is not archived", u)
+	}
+
+	if r.header.Get("WARC-Type") == "response" {
+		return r.response(req)
+	}
+
+	// identical payload, the body is in the refered response
+	target := r.header.Get("WARC-Refers-To-Target-URI")
+
+	original, ok := a.responses[target+" "+r.header.Get("WARC-Refers-To-Date")]
+	if !ok {
+		original, ok = a.responses[target]
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("Err: revisit of %s refers to %s which is not archived", u, target)
+	}
+
+	resp, err := r.response(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	payload, err := original.response(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = payload.Body
+
+	return resp, nil
+}
+
+// runReplay runs `loca replay [options] FILE.warc.gz...`,
+// rebuilding the mirror from the archived responses without
+// touching the network, with the options of a live crawl
+func runReplay(args []string) error {
+	var starts listFlag
+
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Var(&starts, "start", "Start page of the replayed crawl, repeatable, the first archived URLs by default")
+
+	flag.VisitAll(func(f *flag.Flag) {
+		fs.Var(commandLineFlag{f}, f.Name, f.Usage)
+	})
+
+	fs.Parse(args)
+
+	replaying = true
+
+	err := parseOptions(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	// no one to be polite to
+	*delay = 0
+
+	pages = replayed.startPages()
+	if len(starts) > 0 {
+		pages, err = parseStartPages(starts)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(pages) == 0 {
+		return fmt.Errorf("no archived responses in %s", strings.Join(flag.Args(), ", "))
+	}
+
+	run()
+
+	return nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWARCArchive(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gzip":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			gz.Write([]byte("compressed text"))
+			gz.Close()
+		case "/cached":
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<p>same payload</p>"))
+		}
+	}))
+	defer srv.Close()
+
+	tmp, err := ioutil.TempDir("", "loca-replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	base := filepath.Join(tmp, "crawl.warc.gz")
+
+	w, err := newWARCWriter(base, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the transport doesn't decompress bodies we asked for
+	for _, p := range []string{"/a", "/gzip", "/b", "/cached"} {
+		req, _ := http.NewRequest("GET", srv.URL+p, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := w.capture(resp, "", time.Now())
+		ioutil.ReadAll(resp.Body)
+		c.finish()
+		resp.Body.Close()
+	}
+
+	w.close()
+
+	a, err := openWARCArchive([]string{base})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	starts := a.startPages()
+	if strings.Join(starts, " ") != srv.URL+"/a" {
+		t.Error("Expected: the first archived response", "But Got:", starts)
+	}
+
+	c := &http.Client{Transport: a}
+
+	tests := map[string]string{
+		"/a":    "<p>same payload</p>",
+		"/b":    "<p>same payload</p>",
+		"/gzip": "compressed text",
+	}
+
+	for p, expected := range tests {
+		resp, err := c.Get(srv.URL + p)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if resp.Header.Get("Content-Encoding") == "gzip" {
+			decodeBody(resp)
+		}
+
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(data) != expected {
+			t.Error("Expected:", expected, "But Got:", string(data))
+		}
+	}
+
+	if _, err := c.Get(srv.URL + "/cached"); err == nil {
+		t.Error("Expected: an error for not archived URLs", "But Got: nil")
+	}
+}
+
+func TestScanPlainWARC(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "loca-replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	block := "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nhello"
+	record := "WARC/1.1\r\n" +
+		"WARC-Type: response\r\n" +
+		"WARC-Target-URI: https://example.com/\r\n" +
+		"Content-Length: " + strconv.Itoa(len(block)) + "\r\n\r\n" +
+		block + "\r\n\r\n"
+
+	name := filepath.Join(tmp, "plain.warc")
+	ioutil.WriteFile(name, []byte(record+record), 0666)
+
+	records, err := scanWARC(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 || records[1].offset != int64(len(record)) {
+		t.Error("Expected: 2 records", "But Got:", len(records))
+		return
+	}
+
+	req, _ := http.NewRequest("GET", "https://example.com/", nil)
+
+	resp, err := records[1].response(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, _ := ioutil.ReadAll(resp.Body)
+	if string(data) != "hello" {
+		t.Error("Expected: hello", "But Got:", string(data))
+	}
+}
+
+func TestRunReplayOffline(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/style.css":
+			w.Header().Set("Content-Type", "text/css")
+			w.Write([]byte("body { color: red }"))
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<html><head><link rel="stylesheet" href="/style.css"></head><body>replayed</body></html>`))
+		}
+	}))
+
+	tmp, err := ioutil.TempDir("", "loca-replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	base := filepath.Join(tmp, "crawl.warc.gz")
+
+	w, err := newWARCWriter(base, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// orphan.html is archived, but not linked from the start page
+	for _, p := range []string{"/", "/style.css", "/orphan.html"} {
+		resp, err := http.Get(srv.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := w.capture(resp, "", time.Now())
+		ioutil.ReadAll(resp.Body)
+		c.finish()
+		resp.Body.Close()
+	}
+
+	w.close()
+
+	// nothing to reach anymore, the offline list included
+	srv.Close()
+
+	savedDir, savedDelay, savedList := *dir, *delay, *offlineHosts
+	savedOfflineDisabled := *offlineDisabled
+	savedTransport := client.Transport
+	savedMirror, savedGraph := mirror, graph
+	defer func() {
+		*dir, *delay, *offlineHosts = savedDir, savedDelay, savedList
+		*offlineDisabled = savedOfflineDisabled
+		client.Transport = savedTransport
+		mirror, graph = savedMirror, savedGraph
+		replaying, replayed = false, nil
+		flag.Set("progress-disabled", "false")
+		flag.CommandLine.Parse(nil)
+	}()
+
+	out := filepath.Join(tmp, "mirror")
+
+	err = runReplay([]string{
+		"-dir", out,
+		"-offline-list", srv.URL + "/hosts",
+		"-progress-disabled",
+		base,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := openManifest(filepath.Join(out, metaDir, manifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, u := range []string{srv.URL + "/", srv.URL + "/style.css"} {
+		if m.get(u) == nil {
+			t.Error("Expected:", u, "mirrored", "But Got: nothing")
+		}
+	}
+
+	if m.get(srv.URL+"/orphan.html") != nil {
+		t.Error("Expected: only pages reached from the start page", "But Got:", srv.URL+"/orphan.html")
+	}
+
+	if !*offlineDisabled {
+		t.Error("Expected: the remote offline list skipped", "But Got: offline rewriting enabled")
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// partialDir keeps interrupted downloads inside metaDir
+	partialDir = "partial"
+)
+
+// partialDownload is the state of an interrupted download,
+// stored next to its data as JSON
+type partialDownload struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// validator gets the If-Range value, weak ETags can't be used
+func (p *partialDownload) validator() string {
+	if p.ETag != "" && !strings.HasPrefix(p.ETag, "W/") {
+		return p.ETag
+	}
+
+	return p.LastModified
+}
+
+// partialPath gets the data file of URL's partial download
+func partialPath(u string) string {
+	sum := sha256.Sum256([]byte(u))
+
+	return metaPath(filepath.Join(partialDir, hex.EncodeToString(sum[:])))
+}
+
+// loadPartial loads the partial download of URL and its size,
+// nil is returned when there is nothing to resume
+func loadPartial(u string) (*partialDownload, int64) {
+	p := partialPath(u)
+
+	fi, err := os.Stat(p)
+	if err != nil || fi.Size() == 0 {
+		return nil, 0
+	}
+
+	data, err := ioutil.ReadFile(p + ".json")
+	if err != nil {
+		return nil, 0
+	}
+
+	state := &partialDownload{}
+	if err := json.Unmarshal(data, state); err != nil ||
+		state.URL != u || state.validator() == "" {
+		return nil, 0
+	}
+
+	return state, fi.Size()
+}
+
+// removePartial removes the partial download of URL
+func removePartial(u string) {
+	p := partialPath(u)
+	os.Remove(p)
+	os.Remove(p + ".json")
+}
+
+// setResume asks for the rest of an interrupted download,
+// If-Range makes the server send it all if the file has changed
+func setResume(req *http.Request, u string) {
+	state, size := loadPartial(u)
+	if state == nil {
+		return
+	}
+
+	req.Header.Set("Range", "bytes="+strconv.FormatInt(size, 10)+"-")
+	req.Header.Set("If-Range", state.validator())
+	// byte ranges of compressed bodies are useless to us
+	req.Header.Set("Accept-Encoding", "identity")
+}
+
+// isResumable checks whether the response body can be kept
+// as a partial download, text is processed as a whole and
+// compressed bodies are decoded on the fly
+func isResumable(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK &&
+		resp.StatusCode != http.StatusPartialContent {
+		return false
+	}
+
+	if isText(mediaType(resp.Header)) {
+		return false
+	}
+
+	encoding := strings.TrimSpace(resp.Header.Get("Content-Encoding"))
+
+	return encoding == "" || strings.EqualFold(encoding, "identity")
+}
+
+// parseContentRange parses "bytes START-END/TOTAL",
+// total is -1 when unknown
+func parseContentRange(v string) (start, total int64, err error) {
+	v = strings.TrimSpace(v)
+	if !strings.HasPrefix(v, "bytes ") {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", v)
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(v, "bytes "), "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", v)
+	}
+
+	bounds := strings.SplitN(parts[0], "-", 2)
+
+	start, err = strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", v)
+	}
+
+	total = -1
+	if parts[1] != "*" {
+		total, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid Content-Range %q", v)
+		}
+	}
+
+	return start, total, nil
+}
+
+// rangeOffset gets where the body of a 206 response starts
+func rangeOffset(resp *http.Response) int64 {
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0
+	}
+
+	start, _, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return 0
+	}
+
+	return start
+}
+
+// savePartial saves the response body to URL's partial download,
+// appending to it on 206, then moves it to name once complete.
+// An interrupted download is kept for resuming if it can be validated
+func savePartial(resp *http.Response, u, name string) error {
+	p := partialPath(u)
+
+	err := os.MkdirAll(filepath.Dir(p), 0777)
+	if err != nil {
+		return err
+	}
+
+	var f *os.File
+
+	if resp.StatusCode == http.StatusPartialContent {
+		fi, err := os.Stat(p)
+		if err != nil || fi.Size() != rangeOffset(resp) {
+			removePartial(u)
+			return fmt.Errorf("Err: unexpected Content-Range %q of %s",
+				resp.Header.Get("Content-Range"),
+				u,
+			)
+		}
+
+		f, err = os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			return err
+		}
+	} else {
+		// new or changed file, start over
+		state := &partialDownload{
+			URL:          u,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		}
+
+		data, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+
+		err = ioutil.WriteFile(p+".json", data, 0666)
+		if err != nil {
+			return err
+		}
+
+		f, err = os.Create(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = io.Copy(f, resp.Body)
+
+	if e := f.Close(); err == nil {
+		err = e
+	}
+
+	if err != nil {
+		// no way to resume it safely
+		if state, _ := loadPartial(u); state == nil || err == errTooLarge {
+			removePartial(u)
+		}
+		return err
+	}
+
+	err = placeFile(p, name, nil)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(p + ".json")
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResumeDownload(t *testing.T) {
+	tmp, err := ioutil.TempDir("", tempFilePrefix)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(tmp)
+
+	*dir = tmp
+	*delay = 0
+	defer func() {
+		*dir = defaultDir
+		*delay = defaultDelayBeforeRequest
+	}()
+
+	content := []byte(strings.Repeat("0123456789", 1000))
+	modified := time.Date(2019, 8, 15, 0, 0, 0, 0, time.UTC)
+
+	var ranges []string
+	drop := true
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+
+		// drop the connection half way
+		if drop {
+			drop = false
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+
+		http.ServeContent(w, r, "file.bin", modified, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	u := server.URL + "/file.bin"
+
+	if _, err := fetchToFile(u); err == nil {
+		t.Error("Expected an err of the dropped connection, But Got: nil")
+		return
+	}
+
+	if _, size := loadPartial(u); size != int64(len(content)/2) {
+		t.Error("Expected a partial download of", len(content)/2, "bytes, But Got:", size)
+		return
+	}
+
+	e, err := fetchToFile(u)
+	if err != nil {
+		t.Error("fetchToFile() ->", err)
+		return
+	}
+
+	if ranges[1] != "bytes="+strconv.Itoa(len(content)/2)+"-" {
+		t.Error("Expected a Range request, But Got:", ranges[1])
+	}
+
+	data, err := ioutil.ReadFile(localPath(e.URL))
+	if err != nil || !bytes.Equal(data, content) {
+		t.Error("Resumed file doesn't equal the original", err)
+	}
+
+	if state, _ := loadPartial(u); state != nil {
+		t.Error("Partial download not removed")
+	}
+
+}
+
+func TestParseContentRange(t *testing.T) {
+	start, total, err := parseContentRange("bytes 500-999/1000")
+	if err != nil || start != 500 || total != 1000 {
+		t.Error("Wrong parsed Content-Range", start, total, err)
+	}
+
+	start, total, err = parseContentRange("bytes 500-999/*")
+	if err != nil || start != 500 || total != -1 {
+		t.Error("Wrong parsed Content-Range", start, total, err)
+	}
+
+	for _, v := range []string{"", "500-999/1000", "bytes x-999/1000"} {
+		if _, _, err := parseContentRange(v); err == nil {
+			t.Error(v, "is invalid, but got no err")
+		}
+	}
+
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	// rulePrefixRegexp marks a pattern as a regular expression,
+	// anything else is treated as a glob
+	rulePrefixRegexp = "re:"
+)
+
+// rule is a single allow or deny filter
+type rule struct {
+	allow   bool
+	pattern string
+	// origin tells where the rule came from,
+	// like -include or rules.txt:3
+	origin string
+	// path is true when the pattern is matched
+	// against the URL path instead of the whole URL
+	path bool
+	re   *regexp.Regexp
+}
+
+// String describes the rule for logging
+func (r *rule) String() string {
+	verdict := "deny"
+	if r.allow {
+		verdict = "allow"
+	}
+
+	return fmt.Sprintf("%s %s (%s)", verdict, r.pattern, r.origin)
+}
+
+// match checks whether the rule matches u
+func (r *rule) match(u string, parsed *url.URL) bool {
+	if r.re == nil {
+		// catch-all
+		return true
+	}
+
+	if r.path {
+		return r.re.MatchString(parsed.Path)
+	}
+
+	return r.re.MatchString(u)
+}
+
+// listFlag is a repeatable command-line flag
+type listFlag []string
+
+// String joins the values for flag usage
+func (l *listFlag) String() string {
+	return strings.Join(*l, " ")
+}
+
+// Set appends a value each time the flag is used
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// newRule compiles pattern into an allow or deny rule
+func newRule(allow bool, pattern, origin string) (*rule, error) {
+	r := &rule{
+		allow:   allow,
+		pattern: pattern,
+		origin:  origin,
+	}
+
+	var (
+		expr string
+		err  error
+	)
+
+	if strings.HasPrefix(pattern, rulePrefixRegexp) {
+		expr = strings.TrimPrefix(pattern, rulePrefixRegexp)
+	} else {
+		expr = globToRegexp(pattern)
+
+		switch {
+		// matched against the path, e.g /docs/*/edit
+		case strings.HasPrefix(pattern, "/"):
+			r.path = true
+		// matched against the whole URL, e.g *://docs.python.org/3/*
+		case strings.Contains(pattern, "://"):
+		// matched against the end of the URL from a slash,
+		// e.g *.pdf or docs/*
+		default:
+			expr = "(^|/)" + strings.TrimPrefix(expr, "^")
+		}
+	}
+
+	r.re, err = regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", origin, err)
+	}
+
+	return r, nil
+}
+
+// globToRegexp converts a glob into an anchored regular expression,
+// "*" matches anything but a slash, "**" matches anything
+// and "?" matches a single letter except a slash
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+				continue
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	b.WriteString("$")
+
+	return b.String()
+}
+
+// parseRules parses rules data, one rule per line:
+//
+//	allow /docs/**
+//	deny  /docs/*/edit
+//	deny  re:\.(exe|msi)$
+//
+// empty lines and lines starting with # are ignored
+func parseRules(data []byte, name string) ([]*rule, error) {
+	var rules []*rule
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	n := 0
+
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected `allow|deny PATTERN`", name, n)
+		}
+
+		var allow bool
+		switch strings.ToLower(fields[0]) {
+		case "allow", "+":
+			allow = true
+		case "deny", "-":
+			allow = false
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown action %q", name, n, fields[0])
+		}
+
+		r, err := newRule(allow, fields[1], fmt.Sprintf("%s:%d", name, n))
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, r)
+	}
+
+	return rules, scanner.Err()
+}
+
+// buildRules builds the ordered rule list, first match wins:
+// -exclude patterns, then the -rules file, then -include patterns.
+// When any -include is given, URLs matching nothing are denied
+func buildRules(includes, excludes []string, rulesFile string) ([]*rule, error) {
+	var rules []*rule
+
+	for _, p := range excludes {
+		r, err := newRule(false, p, "-exclude")
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+
+	if rulesFile != "" {
+		data, err := ioutil.ReadFile(rulesFile)
+		if err != nil {
+			return nil, err
+		}
+
+		fileRules, err := parseRules(data, rulesFile)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, fileRules...)
+	}
+
+	for _, p := range includes {
+		r, err := newRule(true, p, "-include")
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+
+	if len(includes) > 0 {
+		rules = append(rules, &rule{
+			allow:   false,
+			pattern: "*",
+			origin:  "not included",
+		})
+	}
+
+	return rules, nil
+}
+
+// matchRules returns the first rule matching u,
+// or nil when none does
+func matchRules(rules []*rule, u string, parsed *url.URL) *rule {
+	for _, r := range rules {
+		if r.match(u, parsed) {
+			return r
+		}
+	}
+
+	return nil
+}
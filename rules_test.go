@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestGlobRules(t *testing.T) {
+	savedRules := urlRules
+	defer func() {
+		urlRules = savedRules
+	}()
+
+	tests := []struct {
+		glob string
+		URLs map[string]bool
+	}{
+		{"*.pdf", map[string]bool{
+			"https://example.com/manual.pdf":       true,
+			"https://example.com/docs/a/guide.pdf": true,
+			"https://example.com/pdf/guide.html":   false,
+		}},
+		{"docs/*", map[string]bool{
+			"https://example.com/docs/intro":     true,
+			"https://example.com/docs/a/intro":   false,
+			"https://example.com/mydocs/intro":   false,
+			"https://example.com/en/docs/intro":  true,
+			"https://example.com/blog/docs.html": false,
+		}},
+		{"/docs/**", map[string]bool{
+			"https://example.com/docs/a/intro":  true,
+			"https://example.com/en/docs/intro": false,
+		}},
+		{"*://docs.example.com/3/*", map[string]bool{
+			"https://docs.example.com/3/intro":   true,
+			"https://docs.example.com/3/a/intro": false,
+			"https://www.example.com/3/intro":    false,
+		}},
+		{"/a?c.html", map[string]bool{
+			"https://example.com/abc.html": true,
+			"https://example.com/a/c.html": false,
+		}},
+	}
+
+	for _, test := range tests {
+		var err error
+
+		urlRules, err = buildRules(nil, []string{test.glob}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for u, excluded := range test.URLs {
+			allowed, _, err := filterURL(u)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if allowed == excluded {
+				t.Error(test.glob, u, "Expected: excluded", excluded, "But Got: allowed", allowed)
+			}
+		}
+	}
+
+}
+
+func TestParseRules(t *testing.T) {
+	const data = `
+# docs only, but not the editor
+deny /docs/*/edit
+allow /docs/**
+deny re:.
+`
+	rules, err := parseRules([]byte(data), "rules.txt")
+	if err != nil {
+		t.Error("parseRules() ->", err)
+		return
+	}
+
+	if len(rules) != 3 {
+		t.Error("Wrong parsed rules count", len(rules))
+		return
+	}
+
+	if rules[0].origin != "rules.txt:3" {
+		t.Error("Wrong rule origin", rules[0].origin)
+	}
+
+	invalid := []string{
+		"allow",
+		"maybe /docs/**",
+		"deny re:(",
+	}
+
+	for _, v := range invalid {
+		if _, err := parseRules([]byte(v), "rules.txt"); err == nil {
+			t.Error(v, "is invalid, but got no err")
+		}
+	}
+
+}
+
+func TestMatchRules(t *testing.T) {
+	rules, err := buildRules(
+		[]string{"/docs/**"},
+		[]string{"/docs/*/edit", "re:\\.pdf$"},
+		"",
+	)
+
+	if err != nil {
+		t.Error("buildRules() ->", err)
+		return
+	}
+
+	URLs := map[string]bool{
+		"https://example.com/docs/intro":        true,
+		"https://example.com/docs/a,b/page":     true,
+		"https://example.com/docs/intro/edit":   false,
+		"https://example.com/docs/a/b/edit":     true,
+		"https://example.com/docs/manual.pdf":   false,
+		"https://example.com/blog/hello-world/": false,
+	}
+
+	for u, expected := range URLs {
+		parsed, _ := url.Parse(u)
+
+		r := matchRules(rules, u, parsed)
+		if r == nil {
+			t.Error(u, "matched no rule")
+			continue
+		}
+
+		if r.allow != expected {
+			t.Error(u, "Expected:", expected, "But Got:", r)
+		}
+	}
+
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	html5 "golang.org/x/net/html"
+)
+
+const (
+	searchName = "search.json"
+
+	defaultSearchResults = 10
+	// snippetWidth is about how many bytes of text a snippet shows
+	snippetWidth = 160
+	// titleWeight counts title words as if they appeared that often
+	titleWeight = 3
+)
+
+// searchDoc is an indexed page
+type searchDoc struct {
+	URL   string `json:"url"`
+	Title string `json:"title"`
+	Text  string `json:"text"`
+}
+
+// searchPosting is a page containing a term, and how often
+type searchPosting struct {
+	Doc  int `json:"d"`
+	Freq int `json:"f"`
+}
+
+// searchIndex is an inverted index of the visible text of pages,
+// stored as search.json inside metaDir
+type searchIndex struct {
+	Docs  []*searchDoc               `json:"docs"`
+	Terms map[string][]searchPosting `json:"terms"`
+}
+
+// searchResult is a page matching a query
+type searchResult struct {
+	URL     string
+	Title   string
+	Snippet string
+	Score   float64
+}
+
+// blockElements break the visible text into lines
+var blockElements = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true,
+	"br": true, "dd": true, "div": true, "dl": true, "dt": true,
+	"fieldset": true, "figcaption": true, "figure": true, "footer": true,
+	"form": true, "h1": true, "h2": true, "h3": true, "h4": true,
+	"h5": true, "h6": true, "header": true, "hr": true, "li": true,
+	"main": true, "nav": true, "ol": true, "p": true, "pre": true,
+	"section": true, "table": true, "td": true, "th": true, "tr": true,
+	"ul": true,
+}
+
+// extractLines gets the title and the lines of visible text of
+// an HTML page, scripts, styles and the like are dropped
+func extractLines(s string) (string, []string, error) {
+	doc, err := html5.Parse(strings.NewReader(s))
+	if err != nil {
+		return "", nil, err
+	}
+
+	var title string
+	var lines, line []string
+
+	flush := func() {
+		if len(line) > 0 {
+			lines = append(lines, strings.Join(line, " "))
+			line = nil
+		}
+	}
+
+	var walk func(n *html5.Node)
+	walk = func(n *html5.Node) {
+		if n.Type == html5.ElementNode {
+			switch n.Data {
+			case "script", "style", "noscript", "template", "svg":
+				return
+			case "title":
+				if n.FirstChild != nil && title == "" {
+					title = strings.Join(strings.Fields(n.FirstChild.Data), " ")
+				}
+				return
+			}
+		}
+
+		if n.Type == html5.TextNode {
+			line = append(line, strings.Fields(n.Data)...)
+		}
+
+		block := n.Type == html5.ElementNode && blockElements[n.Data]
+		if block {
+			flush()
+		}
+
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+
+		if block {
+			flush()
+		}
+	}
+
+	walk(doc)
+	flush()
+
+	return title, lines, nil
+}
+
+// extractText gets the title and the visible text of an HTML page
+func extractText(s string) (string, string, error) {
+	title, lines, err := extractLines(s)
+
+	return title, strings.Join(lines, " "), err
+}
+
+// tokenize splits s into lower cased words
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// newSearchIndex indexes the docs
+func newSearchIndex(docs []*searchDoc) *searchIndex {
+	idx := &searchIndex{
+		Docs:  docs,
+		Terms: map[string][]searchPosting{},
+	}
+
+	for i, d := range docs {
+		freq := map[string]int{}
+
+		for _, term := range tokenize(d.Text) {
+			freq[term]++
+		}
+
+		for _, term := range tokenize(d.Title) {
+			freq[term] += titleWeight
+		}
+
+		for term, n := range freq {
+			idx.Terms[term] = append(idx.Terms[term], searchPosting{i, n})
+		}
+	}
+
+	return idx
+}
+
+// search gets the pages having every term of the query,
+// best first, ranked by tf-idf
+func (idx *searchIndex) search(query string, limit int) []*searchResult {
+	terms := tokenize(query)
+	if len(terms) == 0 || len(idx.Docs) == 0 {
+		return nil
+	}
+
+	scores := map[int]float64{}
+	matched := map[int]int{}
+
+	seen := map[string]bool{}
+	distinct := 0
+
+	for _, term := range terms {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+		distinct++
+
+		postings := idx.Terms[term]
+		idf := math.Log(1 + float64(len(idx.Docs))/float64(len(postings)+1))
+
+		for _, p := range postings {
+			scores[p.Doc] += (1 + math.Log(float64(p.Freq))) * idf
+			matched[p.Doc]++
+		}
+	}
+
+	var results []*searchResult
+
+	for i, score := range scores {
+		if matched[i] < distinct {
+			continue
+		}
+
+		d := idx.Docs[i]
+
+		results = append(results, &searchResult{
+			URL:     d.URL,
+			Title:   d.Title,
+			Snippet: snippet(d.Text, terms),
+			Score:   score,
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].URL < results[j].URL
+	})
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results
+}
+
+// snippet gets the text around the first term found in text
+func snippet(text string, terms []string) string {
+	lower := strings.ToLower(text)
+
+	at := -1
+	for _, term := range terms {
+		if i := strings.Index(lower, term); i >= 0 && (at == -1 || i < at) {
+			at = i
+		}
+	}
+
+	// lower casing may change the length of some letters
+	if at < 0 || len(lower) != len(text) {
+		at = 0
+	}
+
+	start := at - snippetWidth/3
+	if start < 0 {
+		start = 0
+	}
+
+	end := start + snippetWidth
+	if end > len(text) {
+		end = len(text)
+	}
+
+	// whole words only
+	if start > 0 {
+		if i := strings.IndexByte(text[start:end], ' '); i >= 0 {
+			start += i + 1
+		}
+	}
+
+	if end < len(text) {
+		if i := strings.LastIndexByte(text[start:end], ' '); i > 0 {
+			end = start + i
+		}
+	}
+
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+
+	s := text[start:end]
+
+	if start > 0 {
+		s = "…" + s
+	}
+
+	if end < len(text) {
+		s += "…"
+	}
+
+	return s
+}
+
+// loadSearchIndex reads the index at p
+func loadSearchIndex(p string) (*searchIndex, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseSearchIndex(data)
+}
+
+// parseSearchIndex parses the JSON of an index
+func parseSearchIndex(data []byte) (*searchIndex, error) {
+	idx := &searchIndex{}
+
+	if err := json.Unmarshal(data, idx); err != nil {
+		return nil, err
+	}
+
+	return idx, nil
+}
+
+// indexMirrored indexes the HTML pages of the manifest into p,
+// pages whose files can't be read back keep their previous text
+func indexMirrored(m *manifest, p string) error {
+	previous := map[string]*searchDoc{}
+
+	if old, err := loadSearchIndex(p); err == nil {
+		for _, d := range old.Docs {
+			previous[d.URL] = d
+		}
+	}
+
+	var docs []*searchDoc
+
+	for _, e := range m.list() {
+		if !isHTML(e.ContentType) {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(mirroredPath(e.File))
+		if err != nil {
+			if d, ok := previous[e.URL]; ok {
+				docs = append(docs, d)
+			}
+			continue
+		}
+
+		s, _, _ := decodeText(data, e.ContentType)
+
+		title, text, err := extractText(s)
+		if err != nil {
+			logError(err)
+			continue
+		}
+
+		docs = append(docs, &searchDoc{
+			URL:   e.URL,
+			Title: title,
+			Text:  text,
+		})
+	}
+
+	data, err := json.Marshal(newSearchIndex(docs))
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(p, data, 0666)
+}
+
+// searchPage is the /search page of `loca serve`
+var searchPage = template.Must(template.New("search").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{if .Query}}{{.Query}} - {{end}}Search</title>
+</head>
+<body>
+<form action="/search">
+<input type="search" name="q" value="{{.Query}}" autofocus>
+<button>Search</button>
+</form>
+{{if .Query}}<p>{{len .Results}} result(s)</p>{{end}}
+<ol>
+{{range .Results}}<li>
+<a href="{{.Path}}">{{if .Title}}{{.Title}}{{else}}{{.URL}}{{end}}</a>
+<p>{{.Snippet}}</p>
+<small>{{.URL}}</small>
+</li>
+{{end}}</ol>
+</body>
+</html>
+`))
+
+// serveSearch serves the results of the query q
+func serveSearch(w http.ResponseWriter, r *http.Request, idx *searchIndex) {
+	type pageResult struct {
+		*searchResult
+		// Path is the original path served by the mirror
+		Path string
+	}
+
+	q := r.URL.Query().Get("q")
+
+	var results []pageResult
+
+	if idx != nil {
+		for _, res := range idx.search(q, 0) {
+			p := res.URL
+			if parsed, err := url.Parse(res.URL); err == nil {
+				p = "/" + parsed.Host + parsed.RequestURI()
+			}
+
+			results = append(results, pageResult{res, p})
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	err := searchPage.Execute(w, map[string]interface{}{
+		"Query":   q,
+		"Results": results,
+	})
+	if err != nil {
+		logError(err)
+	}
+}
+
+// runSearch runs `loca search [options] "query"`,
+// printing the best matching pages of the mirror
+func runSearch(args []string) error {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	fs.StringVar(dir, "dir", *dir, "Dirctory root of the mirror.")
+	limit := fs.Int("n", defaultSearchResults, "Number of results to show, 0 shows all")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("Missing query to search for")
+	}
+
+	idx, err := loadSearchIndex(metaPath(searchName))
+	if err != nil {
+		return fmt.Errorf("loadSearchIndex()-> %v", err)
+	}
+
+	results := idx.search(strings.Join(fs.Args(), " "), *limit)
+	if len(results) == 0 {
+		fmt.Fprintln(os.Stderr, "No results")
+		return nil
+	}
+
+	for i, res := range results {
+		title := res.Title
+		if title == "" {
+			title = res.URL
+		}
+
+		fmt.Printf("%d. %s\n   %s\n   %s\n\n", i+1, title, res.URL, res.Snippet)
+	}
+
+	return nil
+}
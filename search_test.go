@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtractText(t *testing.T) {
+	page := `<html><head><title> Install
+	Guide </title><style>p{color:red}</style></head>
+	<body><script>var hidden = 1</script><h1>Installing</h1>
+	<p>Run   the installer.</p><noscript>enable js</noscript></body></html>`
+
+	title, text, err := extractText(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if title != "Install Guide" {
+		t.Error("Expected: Install Guide", "But Got:", title)
+	}
+
+	if text != "Installing Run the installer." {
+		t.Error("Expected: Installing Run the installer.", "But Got:", text)
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	idx := newSearchIndex([]*searchDoc{
+		{URL: "https://example.com/a", Title: "Cats", Text: "cats are great, cats sleep a lot"},
+		{URL: "https://example.com/b", Title: "Dogs", Text: "dogs and cats play together"},
+		{URL: "https://example.com/c", Title: "Birds", Text: "birds sing"},
+	})
+
+	results := idx.search("Cats", 0)
+	if len(results) != 2 {
+		t.Fatal("Expected: 2", "But Got:", len(results))
+	}
+
+	if results[0].URL != "https://example.com/a" {
+		t.Error("Expected: https://example.com/a", "But Got:", results[0].URL)
+	}
+
+	// every term must match
+	results = idx.search("cats dogs", 0)
+	if len(results) != 1 || results[0].URL != "https://example.com/b" {
+		t.Error("Expected: https://example.com/b", "But Got:", results)
+	}
+
+	if results := idx.search("fish", 0); len(results) != 0 {
+		t.Error("Expected: no results", "But Got:", results)
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	text := strings.Repeat("lorem ipsum ", 40) + "the needle is here " + strings.Repeat("dolor sit ", 40)
+
+	s := snippet(text, []string{"needle"})
+
+	if !strings.Contains(s, "needle") {
+		t.Error("Expected: needle in", s)
+	}
+
+	if !strings.HasPrefix(s, "…") || !strings.HasSuffix(s, "…") {
+		t.Error("Expected: …snippet…", "But Got:", s)
+	}
+
+	if got := snippet("short text", []string{"text"}); got != "short text" {
+		t.Error("Expected: short text", "But Got:", got)
+	}
+}
+
+func TestServeSearch(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "loca-search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	oldDir := *dir
+	*dir = tmp
+	defer func() {
+		*dir = oldDir
+	}()
+
+	err = os.MkdirAll(filepath.Join(tmp, "html", "example.com"), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page := "<title>Pricing</title><p>Plans start at 5 dollars</p>"
+
+	err = ioutil.WriteFile(filepath.Join(tmp, "html", "example.com", "pricing.html"), []byte(page), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := openManifest(metaPath(manifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.put(&mirrorEntry{
+		URL:         "https://example.com/pricing",
+		File:        "html/example.com/pricing.html",
+		ContentType: "text/html",
+	})
+
+	if err := indexMirrored(m, metaPath(searchName)); err != nil {
+		t.Fatal(err)
+	}
+	m.close()
+
+	r, err := openMirrorReader(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+
+	srv := httptest.NewServer(newMirrorServer(r, m))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/search?q=plans")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	for _, expected := range []string{`href="/example.com/pricing"`, "Pricing", "Plans start at 5 dollars"} {
+		if !strings.Contains(string(body), expected) {
+			t.Error("Expected:", expected, "But Got:", string(body))
+		}
+	}
+}
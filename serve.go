@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+const (
+	defaultServeAddr = "127.0.0.1:8080"
+)
+
+// mirrorServer serves a mirror over HTTP, original paths
+// are mapped to their files through the manifest
+type mirrorServer struct {
+	files *mirrorReader
+	// paths maps the request URIs of the mirrored URLs,
+	// with and without their host, to their entries
+	paths map[string]*mirrorEntry
+	// index is nil when the mirror wasn't indexed
+	index *searchIndex
+}
+
+// newMirrorServer creates a server of the files of the manifest m
+func newMirrorServer(files *mirrorReader, m *manifest) *mirrorServer {
+	s := &mirrorServer{
+		files: files,
+		paths: map[string]*mirrorEntry{},
+	}
+
+	// sorted, so the same path of several hosts
+	// is always served from the same one
+	for _, e := range m.list() {
+		parsed, err := url.Parse(e.URL)
+		if err != nil {
+			continue
+		}
+
+		uri := parsed.RequestURI()
+
+		if _, ok := s.paths[uri]; !ok {
+			s.paths[uri] = e
+		}
+
+		s.paths["/"+parsed.Host+uri] = e
+	}
+
+	if f, _, err := files.open(path.Join(metaDir, searchName)); err == nil {
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+
+		if err == nil {
+			s.index, err = parseSearchIndex(data)
+		}
+
+		if err != nil {
+			logError("parseSearchIndex()->", err)
+		}
+	}
+
+	return s
+}
+
+// isOfflineRequest checks whether r is for an offline-listed host,
+// as a proxy request or as rewritten /host/path
+func isOfflineRequest(r *http.Request) bool {
+	if len(hosts) == 0 {
+		return false
+	}
+
+	if r.URL.Host != "" && isOfflineHost(r.URL.Host) {
+		return true
+	}
+
+	first := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+
+	return strings.Contains(first, ".") && isOfflineHost(first)
+}
+
+// lookup gets the entry of the original request URI of r
+func (s *mirrorServer) lookup(r *http.Request) *mirrorEntry {
+	if e, ok := s.paths[r.URL.RequestURI()]; ok {
+		return e
+	}
+
+	return s.paths[r.URL.Path]
+}
+
+// ServeHTTP serves the file of the original URL,
+// or the file at the path inside the mirror
+func (s *mirrorServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	// nothing to wait for while browsing offline
+	if isOfflineRequest(r) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// the search page wins over a mirrored /search,
+	// which is still served as /host/search
+	if r.URL.Path == "/search" {
+		serveSearch(w, r, s.index)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	contentType := ""
+
+	if e := s.lookup(r); e != nil {
+		name = e.File
+		contentType = e.ContentType
+	}
+
+	// loca's own files aren't part of the site
+	if name == metaDir || strings.HasPrefix(name, metaDir+"/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, modTime, err := s.files.open(name)
+	if err != nil && (name == "" || strings.HasSuffix(r.URL.Path, "/")) {
+		name = path.Join(name, "index.html")
+		f, modTime, err = s.files.open(name)
+	}
+
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+
+	// the type is guessed from the name or sniffed otherwise
+	http.ServeContent(w, r, name, modTime, f)
+}
+
+// runServe runs `loca serve [options] [mirror.zip]`, serving -dir
+// or an -output archive on localhost
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.StringVar(dir, "dir", *dir, "Dirctory root of the mirror.")
+	fs.BoolVar(offlineDisabled, "offline-disabled", *offlineDisabled, "Serve offline-listed hosts as errors instead of 204")
+	fs.StringVar(offlineHosts, "offline-list", *offlineHosts, "List of websites answered with 204 No Content")
+	addr := fs.String("addr", defaultServeAddr, "Address to listen on")
+	fs.Parse(args)
+
+	root := *dir
+	if fs.NArg() > 0 {
+		root = fs.Arg(0)
+	}
+
+	files, err := openMirrorReader(root)
+	if err != nil {
+		return fmt.Errorf("openMirrorReader()-> %v", err)
+	}
+	defer files.close()
+
+	m, err := files.manifest()
+	if err != nil {
+		return fmt.Errorf("manifest()-> %v", err)
+	}
+
+	if !*offlineDisabled {
+		hosts, err = cacheHosts(*offlineHosts)
+		// serving offline shouldn't need the network
+		if err != nil {
+			logError("cacheHosts()->", err)
+		}
+	}
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Serving %s on http://%s/\n", root, ln.Addr())
+
+	return http.Serve(ln, newMirrorServer(files, m))
+}
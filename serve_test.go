@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMirrorServer(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "loca-serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	files := map[string]string{
+		"html/example.com/docs/guide.html": "<p>guide</p>",
+		"assets/js/example.com/app.mjs":    "export default 1",
+		"assets/css/example.com/style.css": "p{}",
+		".loca/manifest.jsonl":             "{}",
+	}
+
+	for name, data := range files {
+		p := filepath.Join(tmp, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0777)
+
+		if err := ioutil.WriteFile(p, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := &manifest{entries: map[string]*mirrorEntry{}}
+	m.entries["https://example.com/docs/guide"] = &mirrorEntry{
+		URL:         "https://example.com/docs/guide",
+		File:        "html/example.com/docs/guide.html",
+		ContentType: "text/html; charset=utf-8",
+	}
+	m.entries["https://example.com/app.mjs?v=2"] = &mirrorEntry{
+		URL:         "https://example.com/app.mjs?v=2",
+		File:        "assets/js/example.com/app.mjs",
+		ContentType: "text/javascript",
+	}
+
+	oldHosts := hosts
+	hosts = []string{"fonts.googleapis.com"}
+	defer func() {
+		hosts = oldHosts
+	}()
+
+	r, err := openMirrorReader(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+
+	srv := httptest.NewServer(newMirrorServer(r, m))
+	defer srv.Close()
+
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"/docs/guide", 200, "text/html; charset=utf-8", "<p>guide</p>"},
+		{"/example.com/docs/guide", 200, "text/html; charset=utf-8", "<p>guide</p>"},
+		{"/app.mjs?v=2", 200, "text/javascript", "export default 1"},
+		{"/assets/css/example.com/style.css", 200, "text/css; charset=utf-8", "p{}"},
+		{"/fonts.googleapis.com/css?family=Roboto", 204, "", ""},
+		{"/.loca/manifest.jsonl", 404, "", ""},
+		{"/missing", 404, "", ""},
+	}
+
+	for _, test := range tests {
+		resp, err := http.Get(srv.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Error("Expected:", test.status, "But Got:", resp.StatusCode, test.path)
+			continue
+		}
+
+		if test.status != 200 {
+			continue
+		}
+
+		if got := resp.Header.Get("Content-Type"); got != test.contentType {
+			t.Error("Expected:", test.contentType, "But Got:", got, test.path)
+		}
+
+		if string(body) != test.body {
+			t.Error("Expected:", test.body, "But Got:", string(body), test.path)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInlineMaxSize = 2 << 20
+)
+
+// inlineAsset is a fetched asset ready to be inlined
+type inlineAsset struct {
+	data        []byte
+	contentType string
+	err         error
+	// fetched is closed once the asset is fetched,
+	// the fields are set by then
+	fetched chan struct{}
+}
+
+// pageInliner inlines the assets of a page,
+// fetching each asset once
+type pageInliner struct {
+	mu      sync.Mutex
+	assets  map[string]*inlineAsset
+	maxSize int64
+	// stash keeps inlined scripts and styles away from
+	// the rewriting of attributes
+	stash []string
+}
+
+// newPageInliner creates an inliner of assets up to maxSize
+func newPageInliner(maxSize int64) *pageInliner {
+	return &pageInliner{
+		assets:  map[string]*inlineAsset{},
+		maxSize: maxSize,
+	}
+}
+
+// fetchAsset fetches and decodes an asset, assets larger than
+// maxSize fail with errTooLarge
+func fetchAsset(u string, maxSize int64) (*inlineAsset, error) {
+	resp, err := fetch(u, *delay)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, &statusError{
+			url:    u,
+			code:   resp.StatusCode,
+			status: resp.Status,
+		}
+	}
+
+	if maxSize > 0 && resp.ContentLength > maxSize {
+		return nil, errTooLarge
+	}
+
+	err = decodeBody(resp)
+	if err != nil {
+		return nil, fmt.Errorf("Err: decodeBody(%s) -> %v", u, err)
+	}
+
+	var body io.Reader = resp.Body
+	if maxSize > 0 {
+		body = io.LimitReader(resp.Body, maxSize+1)
+	}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxSize > 0 && int64(len(data)) > maxSize {
+		return nil, errTooLarge
+	}
+
+	return &inlineAsset{
+		data:        data,
+		contentType: resp.Header.Get("Content-Type"),
+	}, nil
+}
+
+// get gets the asset of u, recording the outcome
+func (p *pageInliner) get(u, from string) *inlineAsset {
+	p.mu.Lock()
+	a, ok := p.assets[u]
+	if !ok {
+		a = &inlineAsset{fetched: make(chan struct{})}
+		p.assets[u] = a
+	}
+	p.mu.Unlock()
+
+	// fetched once, the others wait for it
+	if ok {
+		<-a.fetched
+		return a
+	}
+
+	defer close(a.fetched)
+
+	started := time.Now()
+
+	fetched, err := fetchAsset(u, p.maxSize)
+	if err != nil {
+		a.err = err
+	} else {
+		a.data, a.contentType = fetched.data, fetched.contentType
+	}
+
+	ev := &crawlEvent{
+		Event:    eventFetched,
+		URL:      u,
+		From:     from,
+		Bytes:    int64(len(a.data)),
+		Duration: float64(time.Since(started)) / float64(time.Millisecond),
+	}
+
+	switch {
+	case err == errTooLarge:
+		ev.Event = eventSkipped
+		ev.Rule = "-inline-max-size"
+	case err != nil:
+		ev.Event = eventFailed
+		ev.Error = err.Error()
+	}
+
+	events.record(ev)
+
+	return a
+}
+
+// dataURI gets the data: URI of an asset
+func dataURI(a *inlineAsset) string {
+	return "data:" + parseMediaType(a.contentType) + ";base64," +
+		base64.StdEncoding.EncodeToString(a.data)
+}
+
+// inlineURL gets the data: URI of ref, resolved against base,
+// oversized and failed assets are left as absolute links
+func (p *pageInliner) inlineURL(base, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "data:") || strings.HasPrefix(ref, "#") {
+		return ref
+	}
+
+	u, err := resolveURL(base, ref, true)
+	if err != nil {
+		return ref
+	}
+
+	a := p.get(u, base)
+	if a.err != nil {
+		return u
+	}
+
+	return dataURI(a)
+}
+
+// inlineCSS inlines the url() of css, including fonts and imports
+func (p *pageInliner) inlineCSS(base, css string, depth int) string {
+	return reCSSURL.ReplaceAllStringFunc(css, func(m string) string {
+		sub := reCSSURL.FindStringSubmatch(m)
+
+		ref := strings.TrimSpace(sub[2])
+		if ref == "" || strings.HasPrefix(ref, "data:") {
+			return m
+		}
+
+		u, err := resolveURL(base, ref, true)
+		if err != nil {
+			return m
+		}
+
+		a := p.get(u, base)
+		if a.err != nil {
+			return "url(" + sub[1] + u + sub[3] + ")"
+		}
+
+		// imported stylesheets have urls of their own
+		if isCSS(a.contentType) && depth < 4 {
+			s, _, _ := decodeText(a.data, a.contentType)
+			a = &inlineAsset{
+				data:        []byte(p.inlineCSS(u, s, depth+1)),
+				contentType: "text/css",
+			}
+		}
+
+		return "url(" + sub[1] + dataURI(a) + sub[3] + ")"
+	})
+}
+
+// inlineSrcset inlines the URLs of a srcset value
+func (p *pageInliner) inlineSrcset(base, srcset string) string {
+	candidates := strings.Split(srcset, ",")
+
+	for i, c := range candidates {
+		fields := strings.Fields(c)
+		if len(fields) == 0 {
+			continue
+		}
+
+		fields[0] = p.inlineURL(base, fields[0])
+		candidates[i] = strings.Join(fields, " ")
+	}
+
+	return strings.Join(candidates, ", ")
+}
+
+// stashed hides s from later passes until unstash
+func (p *pageInliner) stashed(s string) string {
+	p.stash = append(p.stash, s)
+
+	return "\x00loca-inline-" + strconv.Itoa(len(p.stash)-1) + "\x00"
+}
+
+// unstash puts back the stashed scripts and styles
+func (p *pageInliner) unstash(s string) string {
+	for i, v := range p.stash {
+		s = strings.Replace(s, "\x00loca-inline-"+strconv.Itoa(i)+"\x00", v, 1)
+	}
+
+	p.stash = nil
+
+	return s
+}
+
+// inlinePage inlines the assets of the HTML page s of u,
+// the assets found by discoverAssetsURLs are fetched
+// ahead concurrently
+func (p *pageInliner) inlinePage(u, s string) string {
+	wg := &sync.WaitGroup{}
+	concurrent := make(chan struct{}, *concurrency)
+
+	for _, ref := range discoverAssetsURLs(s) {
+		asset, err := resolveURL(u, ref, true)
+		if err != nil || strings.HasPrefix(ref, "data:") {
+			continue
+		}
+
+		wg.Add(1)
+		concurrent <- struct{}{}
+
+		go func() {
+			defer wg.Done()
+			defer func() { <-concurrent }()
+
+			p.get(asset, u)
+		}()
+	}
+
+	wg.Wait()
+
+	// stylesheets
+	s = reLinkTag.ReplaceAllStringFunc(s, func(m string) string {
+		if !reStylesheet.MatchString(m) {
+			return m
+		}
+
+		href := reHREF.FindStringSubmatch(m)
+		if href == nil {
+			return m
+		}
+
+		css, err := resolveURL(u, href[1], true)
+		if err != nil {
+			return m
+		}
+
+		a := p.get(css, u)
+		if a.err != nil {
+			return strings.Replace(m, href[1], css, 1)
+		}
+
+		text, _, _ := decodeText(a.data, a.contentType)
+
+		return p.stashed("<style>" + p.inlineCSS(css, text, 0) + "</style>")
+	})
+
+	// scripts
+	s = reScriptSrc.ReplaceAllStringFunc(s, func(m string) string {
+		sub := reScriptSrc.FindStringSubmatch(m)
+
+		js, err := resolveURL(u, sub[2], true)
+		if err != nil {
+			return m
+		}
+
+		a := p.get(js, u)
+		if a.err != nil {
+			return "<script" + sub[1] + ` src="` + js + `"` + sub[3] + "></script>"
+		}
+
+		text, _, _ := decodeText(a.data, a.contentType)
+		// a script can't close its own tag
+		text = strings.Replace(text, "</script", `<\/script`, -1)
+
+		return p.stashed("<script" + sub[1] + sub[3] + ">" + text + "</script>")
+	})
+
+	// images, media and frames
+	s = reSrcAttr.ReplaceAllStringFunc(s, func(m string) string {
+		sub := reSrcAttr.FindStringSubmatch(m)
+		return sub[1] + p.inlineURL(u, sub[2]) + sub[3]
+	})
+
+	s = reSrcset.ReplaceAllStringFunc(s, func(m string) string {
+		sub := reSrcset.FindStringSubmatch(m)
+		return sub[1] + p.inlineSrcset(u, sub[2]) + sub[3]
+	})
+
+	// style attributes and elements
+	s = p.inlineCSS(u, s, 0)
+
+	// links keep working wherever the file goes
+	s = reHREFAttr.ReplaceAllStringFunc(s, func(m string) string {
+		sub := reHREFAttr.FindStringSubmatch(m)
+
+		ref := strings.TrimSpace(sub[2])
+		if strings.HasPrefix(ref, "#") || strings.HasPrefix(ref, "data:") {
+			return m
+		}
+
+		abs, err := resolveURL(u, ref, true)
+		if err != nil {
+			return m
+		}
+
+		return sub[1] + abs + sub[3]
+	})
+
+	return p.unstash(s)
+}
+
+// isCSS checks whether the content type is CSS
+func isCSS(contentType string) bool {
+	return parseMediaType(contentType) == "text/css"
+}
+
+// savePage fetches the page u and saves it as a single HTML file
+// with its assets inlined, to its local path
+func savePage(u string) (err error) {
+	ev := &crawlEvent{
+		Event: eventFetched,
+		URL:   u,
+	}
+	started := time.Now()
+
+	defer func() {
+		ev.Duration = float64(time.Since(started)) / float64(time.Millisecond)
+
+		if err != nil {
+			ev.Event = eventFailed
+			ev.Error = err.Error()
+		}
+
+		events.record(ev)
+	}()
+
+	page, err := fetchAsset(u, 0)
+	if err != nil {
+		return err
+	}
+
+	if !isHTML(page.contentType) {
+		return fmt.Errorf("Err: savePage(%s) -> not HTML but %s", u, parseMediaType(page.contentType))
+	}
+
+	s, _, _ := decodeText(page.data, page.contentType)
+	s = setMetaCharset(s, utf8Name)
+
+	s = newPageInliner(int64(inlineMaxSize)).inlinePage(u, s)
+
+	name := prettyName(u)
+	if !strings.HasSuffix(strings.ToLower(name), ".html") {
+		name += ".html"
+	}
+
+	ev.File = name
+	ev.Bytes = int64(len(s))
+
+	return saveFile(strings.NewReader(s), filepath.Join(*dir, name))
+}
+
+// runPage runs `loca page [options] URL`, like -single-file
+func runPage(args []string) error {
+	err := parseOptions(append([]string{"-single-file"}, args...))
+	if err != nil {
+		return err
+	}
+
+	pages, err = getStartPages()
+	if err != nil {
+		return err
+	}
+
+	run()
+
+	return nil
+}
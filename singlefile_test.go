@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSavePage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/docs/page.html":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(`<html><head>
+<link rel="stylesheet" type="text/css" href="css/site.css">
+<script src="/app.js"></script>
+</head><body style="background: url('bg.png')">
+<a href="other.html">other</a> <a href="#top">top</a>
+<img src="logo.png" srcset="logo.png 1x, big.png 2x">
+</body></html>`))
+		case "/docs/css/site.css":
+			w.Header().Set("Content-Type", "text/css")
+			w.Write([]byte(`@font-face { src: url(../fonts/f.woff2) } h1 { background: url("/docs/logo.png") }`))
+		case "/app.js":
+			w.Header().Set("Content-Type", "application/javascript")
+			w.Write([]byte(`document.write("</script>")`))
+		case "/docs/fonts/f.woff2":
+			w.Header().Set("Content-Type", "font/woff2")
+			w.Write([]byte("font"))
+		case "/docs/logo.png", "/docs/bg.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("png"))
+		case "/docs/big.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(strings.Repeat("x", 128)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	tmp, err := ioutil.TempDir("", "loca-page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	savedEvents, savedDir, savedDelay, savedMax := events, *dir, *delay, inlineMaxSize
+	defer func() {
+		events, *dir, *delay, inlineMaxSize = savedEvents, savedDir, savedDelay, savedMax
+	}()
+
+	events = newEventLog(ioutil.Discard)
+	*dir = tmp
+	*delay = 0
+	inlineMaxSize = 100
+
+	u := srv.URL + "/docs/page.html"
+
+	if err := savePage(u); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(tmp, prettyName(u)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := string(data)
+
+	png := "data:image/png;base64,cG5n"
+
+	for _, expected := range []string{
+		`<style>@font-face { src: url(data:font/woff2;base64,Zm9udA==) } h1 { background: url("` + png + `") }</style>`,
+		`<script>document.write("<\/script>")</script>`,
+		`style="background: url('` + png + `')"`,
+		`<img src="` + png + `" srcset="` + png + ` 1x, ` + srv.URL + `/docs/big.png 2x">`,
+		`href="` + srv.URL + `/docs/other.html"`,
+		`href="#top"`,
+	} {
+		if !strings.Contains(s, expected) {
+			t.Error("Expected:", expected, "But Got:", s)
+		}
+	}
+
+	if strings.Contains(s, "<link") || strings.Contains(s, "\x00") {
+		t.Error("Unexpected leftovers:", s)
+	}
+}
+
+func TestPageInlinerFetchesOnce(t *testing.T) {
+	var requests int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer srv.Close()
+
+	savedEvents, savedDelay := events, *delay
+	defer func() {
+		events, *delay = savedEvents, savedDelay
+	}()
+
+	events = newEventLog(ioutil.Discard)
+	*delay = 0
+
+	p := newPageInliner(defaultInlineMaxSize)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if a := p.get(srv.URL+"/logo.png", srv.URL); string(a.data) != "png" {
+				t.Error("Expected: png", "But Got:", string(a.data), a.err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if requests != 1 {
+		t.Error("Expected: 1 request", "But Got:", requests)
+	}
+}
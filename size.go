@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// sizeFlag is a byte size flag that accepts
+// human friendly values like 512, 500k, 2M or 1G
+type sizeFlag int64
+
+// String formats the size for flag usage
+func (s *sizeFlag) String() string {
+	return formatSize(int64(*s))
+}
+
+// Set parses v into the size
+func (s *sizeFlag) Set(v string) error {
+	n, err := parseSize(v)
+	if err != nil {
+		return err
+	}
+
+	*s = sizeFlag(n)
+	return nil
+}
+
+// parseSize parses sizes like 512, 500k, 2M, 1.5G, 10MB
+// using 1024 based units
+func parseSize(v string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(v))
+	s = strings.TrimSuffix(s, "B")
+
+	multiplier := int64(1)
+
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+	}
+
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+
+	return int64(n * float64(multiplier)), nil
+}
+
+// formatSize formats n bytes using the largest fitting unit
+func formatSize(n int64) string {
+	units := []string{"", "K", "M", "G", "T"}
+
+	f := float64(n)
+	i := 0
+
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+
+	if i == 0 {
+		return strconv.FormatInt(n, 10)
+	}
+
+	return strings.TrimSuffix(strconv.FormatFloat(f, 'f', 1, 64), ".0") + units[i]
+}
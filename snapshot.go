@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotsDir   = "snapshots"
+	snapshotLayout = "2006-01-02T15-04-05Z"
+
+	// diffContext is how many unchanged lines surround changes
+	diffContext = 2
+	// maxDiffCells bounds the memory of diffing two pages
+	maxDiffCells = 1 << 24
+)
+
+var (
+	// snapshotRoot is -dir as given when crawling a -snapshot,
+	// the content store is shared by all its snapshots
+	snapshotRoot string
+
+	// previous is the manifest of the latest snapshot before
+	// this one, in previousDir, its files are revalidated
+	// with conditional requests instead of downloaded again
+	previous    *manifest
+	previousDir string
+)
+
+// startSnapshot makes -dir a new snapshot named after now
+func startSnapshot(now time.Time) error {
+	if *dedupDisabled {
+		return fmt.Errorf("-snapshot shares unchanged files through the content store, it can't be used with -dedup-disabled")
+	}
+
+	if *outputFile != "" {
+		return fmt.Errorf("-snapshot can't be used with -output")
+	}
+
+	snapshotRoot = *dir
+	*dir = filepath.Join(snapshotRoot, snapshotsDir, now.UTC().Format(snapshotLayout))
+
+	names, err := listSnapshots(snapshotRoot)
+	if err != nil || len(names) == 0 {
+		return nil
+	}
+
+	previousDir = filepath.Join(snapshotRoot, snapshotsDir, names[len(names)-1])
+
+	r, err := openMirrorReader(previousDir)
+	if err != nil {
+		return fmt.Errorf("openMirrorReader()-> %v", err)
+	}
+	defer r.close()
+
+	previous, err = r.manifest()
+	if err != nil {
+		return fmt.Errorf("loading the manifest of %s-> %v", previousDir, err)
+	}
+
+	return nil
+}
+
+// previousEntry gets the entry of u in the previous snapshot,
+// if its file is still there
+func previousEntry(u string) *mirrorEntry {
+	if previous == nil {
+		return nil
+	}
+
+	e := previous.get(u)
+	if e == nil {
+		return nil
+	}
+
+	if _, err := os.Stat(filepath.Join(previousDir, e.File)); err != nil {
+		return nil
+	}
+
+	return e
+}
+
+// reuseEntry links the file of e, unchanged since the previous
+// snapshot, into this one
+func reuseEntry(e *mirrorEntry) (*mirrorEntry, error) {
+	_, err := linkObject(filepath.Join(previousDir, e.File), filepath.Join(*dir, e.File))
+	if err != nil {
+		return nil, err
+	}
+
+	reused := *e
+
+	return &reused, mirror.put(&reused)
+}
+
+// storePath gets path of name inside the metadata dir shared
+// by the snapshots of -dir, which is -dir's own without -snapshot
+func storePath(name string) string {
+	if snapshotRoot == "" {
+		return metaPath(name)
+	}
+
+	return filepath.Join(snapshotRoot, metaDir, name)
+}
+
+// listSnapshots gets the names of the snapshots of root, oldest first
+func listSnapshots(root string) ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(root, snapshotsDir))
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, fi := range infos {
+		if fi.IsDir() {
+			names = append(names, fi.Name())
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// snapshotDir gets the dir of the snapshot name of root,
+// name may also be a path to it
+func snapshotDir(root, name string) string {
+	if fi, err := os.Stat(name); err == nil && fi.IsDir() && strings.ContainsRune(name, os.PathSeparator) {
+		return name
+	}
+
+	return filepath.Join(root, snapshotsDir, name)
+}
+
+// snapshotPage is a page of a snapshot with its text lines
+type snapshotPage struct {
+	entry *mirrorEntry
+	lines []string
+}
+
+// loadSnapshotPages gets the HTML pages of the mirror at p
+func loadSnapshotPages(p string) (map[string]*snapshotPage, error) {
+	r, err := openMirrorReader(p)
+	if err != nil {
+		return nil, err
+	}
+	defer r.close()
+
+	m, err := r.manifest()
+	if err != nil {
+		return nil, err
+	}
+
+	pages := map[string]*snapshotPage{}
+
+	for _, e := range m.list() {
+		if !isHTML(e.ContentType) {
+			continue
+		}
+
+		page := &snapshotPage{entry: e}
+		pages[e.URL] = page
+
+		f, _, err := r.open(e.File)
+		if err != nil {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+
+		if err != nil {
+			continue
+		}
+
+		s, _, _ := decodeText(data, e.ContentType)
+
+		title, lines, err := extractLines(s)
+		if err != nil {
+			continue
+		}
+
+		if title != "" {
+			page.lines = append([]string{title}, lines...)
+		} else {
+			page.lines = lines
+		}
+	}
+
+	return pages, nil
+}
+
+// diffOp is a line of a line diff, kind is ' ', '-' or '+'
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// diffLines diffs a and b by their longest common subsequence,
+// pages too large for it are diffed as wholly replaced
+func diffLines(a, b []string) []diffOp {
+	// common prefix and suffix are cheap
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+
+	var ops []diffOp
+	for _, l := range a[:pre] {
+		ops = append(ops, diffOp{' ', l})
+	}
+
+	x, y := a[pre:len(a)-suf], b[pre:len(b)-suf]
+
+	if (len(x)+1)*(len(y)+1) > maxDiffCells {
+		for _, l := range x {
+			ops = append(ops, diffOp{'-', l})
+		}
+		for _, l := range y {
+			ops = append(ops, diffOp{'+', l})
+		}
+	} else {
+		// lcs[i][j] is the LCS length of x[i:] and y[j:]
+		lcs := make([][]int, len(x)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(y)+1)
+		}
+
+		for i := len(x) - 1; i >= 0; i-- {
+			for j := len(y) - 1; j >= 0; j-- {
+				if x[i] == y[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else if lcs[i+1][j] >= lcs[i][j+1] {
+					lcs[i][j] = lcs[i+1][j]
+				} else {
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+
+		i, j := 0, 0
+		for i < len(x) || j < len(y) {
+			switch {
+			case i < len(x) && j < len(y) && x[i] == y[j]:
+				ops = append(ops, diffOp{' ', x[i]})
+				i++
+				j++
+			case j == len(y) || (i < len(x) && lcs[i+1][j] >= lcs[i][j+1]):
+				ops = append(ops, diffOp{'-', x[i]})
+				i++
+			default:
+				ops = append(ops, diffOp{'+', y[j]})
+				j++
+			}
+		}
+	}
+
+	for _, l := range a[len(a)-suf:] {
+		ops = append(ops, diffOp{' ', l})
+	}
+
+	return ops
+}
+
+// writeUnifiedDiff writes the hunks of ops with their context lines
+func writeUnifiedDiff(w io.Writer, from, to string, ops []diffOp) {
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", from, to)
+
+	for start := 0; start < len(ops); {
+		// next change
+		for start < len(ops) && ops[start].kind == ' ' {
+			start++
+		}
+
+		if start == len(ops) {
+			return
+		}
+
+		begin := start - diffContext
+		if begin < 0 {
+			begin = 0
+		}
+
+		// extend while changes are close enough to share context
+		end := start
+		for i := start; i < len(ops); i++ {
+			if ops[i].kind != ' ' {
+				end = i + 1
+			} else if i-end >= 2*diffContext {
+				break
+			}
+		}
+
+		end += diffContext
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		// line numbers of the hunk in both versions
+		oldLine, newLine := 1, 1
+		for _, op := range ops[:begin] {
+			if op.kind != '+' {
+				oldLine++
+			}
+			if op.kind != '-' {
+				newLine++
+			}
+		}
+
+		oldCount, newCount := 0, 0
+		for _, op := range ops[begin:end] {
+			if op.kind != '+' {
+				oldCount++
+			}
+			if op.kind != '-' {
+				newCount++
+			}
+		}
+
+		fmt.Fprintf(w, "@@ -%d,%d +%d,%d @@\n", oldLine, oldCount, newLine, newCount)
+
+		for _, op := range ops[begin:end] {
+			fmt.Fprintf(w, "%c%s\n", op.kind, op.line)
+		}
+
+		start = end
+	}
+}
+
+// diffSnapshots writes the pages added, removed and changed
+// from the mirror at a to the mirror at b, with the diff
+// of the text of the changed ones
+func diffSnapshots(w io.Writer, a, b string) (int, error) {
+	before, err := loadSnapshotPages(a)
+	if err != nil {
+		return 0, err
+	}
+
+	after, err := loadSnapshotPages(b)
+	if err != nil {
+		return 0, err
+	}
+
+	var urls []string
+	for u := range before {
+		urls = append(urls, u)
+	}
+	for u := range after {
+		if _, ok := before[u]; !ok {
+			urls = append(urls, u)
+		}
+	}
+
+	sort.Strings(urls)
+
+	bw := bufio.NewWriter(w)
+	changes := 0
+
+	for _, u := range urls {
+		old, ok := before[u]
+		if !ok {
+			fmt.Fprintf(bw, "added   %s\n", u)
+			changes++
+			continue
+		}
+
+		page, ok := after[u]
+		if !ok {
+			fmt.Fprintf(bw, "removed %s\n", u)
+			changes++
+			continue
+		}
+
+		if strings.Join(old.lines, "\n") == strings.Join(page.lines, "\n") {
+			continue
+		}
+
+		fmt.Fprintf(bw, "changed %s\n", u)
+		writeUnifiedDiff(bw, filepath.Base(a), filepath.Base(b), diffLines(old.lines, page.lines))
+		changes++
+	}
+
+	return changes, bw.Flush()
+}
+
+// runDiff runs `loca diff SNAP1 SNAP2`, showing what changed
+// between two snapshots of -dir
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.StringVar(dir, "dir", *dir, "Dirctory root of the mirror.")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		names, _ := listSnapshots(*dir)
+
+		return fmt.Errorf("expected two snapshots, like loca diff %s %s, snapshots of %s: %s",
+			snapshotLayout, snapshotLayout, *dir, strings.Join(names, ", "),
+		)
+	}
+
+	changes, err := diffSnapshots(os.Stdout,
+		snapshotDir(*dir, fs.Arg(0)),
+		snapshotDir(*dir, fs.Arg(1)),
+	)
+	if err != nil {
+		return err
+	}
+
+	if changes == 0 {
+		fmt.Fprintln(os.Stderr, "No changes")
+	}
+
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffLines(t *testing.T) {
+	a := []string{"title", "one", "two", "three", "four", "five", "six", "seven"}
+	b := []string{"title", "one", "2", "three", "four", "five", "six", "seven", "eight"}
+
+	buf := &bytes.Buffer{}
+	writeUnifiedDiff(buf, "old", "new", diffLines(a, b))
+
+	expected := `--- old
++++ new
+@@ -1,5 +1,5 @@
+ title
+ one
+-two
++2
+ three
+ four
+@@ -7,2 +7,3 @@
+ six
+ seven
++eight
+`
+
+	if buf.String() != expected {
+		t.Error("Expected:", expected, "But Got:", buf.String())
+	}
+}
+
+func TestStartSnapshot(t *testing.T) {
+	oldDir := *dir
+	defer func() {
+		*dir, snapshotRoot = oldDir, ""
+	}()
+
+	*dir = "mirror"
+
+	err := startSnapshot(time.Date(2026, 10, 19, 9, 30, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := filepath.Join("mirror", snapshotsDir, "2026-10-19T09-30-00Z")
+	if *dir != expected {
+		t.Error("Expected:", expected, "But Got:", *dir)
+	}
+
+	// the content store is shared
+	expected = filepath.Join("mirror", metaDir, objectsDir)
+	if got := storePath(objectsDir); got != expected {
+		t.Error("Expected:", expected, "But Got:", got)
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "loca-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	snapshots := map[string]map[string]string{
+		"a": {
+			"https://example.com/pricing": "<title>Pricing</title><p>Basic</p><p>5 dollars</p>",
+			"https://example.com/old":     "<p>old page</p>",
+			"https://example.com/same":    "<p>same</p><script>var v = 1</script>",
+		},
+		"b": {
+			"https://example.com/pricing": "<title>Pricing</title><p>Basic</p><p>7 dollars</p>",
+			"https://example.com/new":     "<p>new page</p>",
+			"https://example.com/same":    "<p>same</p><script>var v = 2</script>",
+		},
+	}
+
+	for snap, pages := range snapshots {
+		var manifest []string
+
+		for u, page := range pages {
+			name := "html/" + strings.TrimPrefix(u, "https://") + ".html"
+
+			p := filepath.Join(tmp, snapshotsDir, snap, filepath.FromSlash(name))
+			os.MkdirAll(filepath.Dir(p), 0777)
+
+			if err := ioutil.WriteFile(p, []byte(page), 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			data, _ := json.Marshal(&mirrorEntry{URL: u, File: name, ContentType: "text/html"})
+			manifest = append(manifest, string(data))
+		}
+
+		p := filepath.Join(tmp, snapshotsDir, snap, metaDir, manifestName)
+		os.MkdirAll(filepath.Dir(p), 0777)
+
+		if err := ioutil.WriteFile(p, []byte(strings.Join(manifest, "\n")), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if names, _ := listSnapshots(tmp); strings.Join(names, " ") != "a b" {
+		t.Error("Expected: a b", "But Got:", names)
+	}
+
+	buf := &bytes.Buffer{}
+
+	changes, err := diffSnapshots(buf, snapshotDir(tmp, "a"), snapshotDir(tmp, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changes != 3 {
+		t.Error("Expected: 3", "But Got:", changes)
+	}
+
+	expected := `added   https://example.com/new
+removed https://example.com/old
+changed https://example.com/pricing
+--- a
++++ b
+@@ -1,3 +1,3 @@
+ Pricing
+ Basic
+-5 dollars
++7 dollars
+`
+
+	if buf.String() != expected {
+		t.Error("Expected:", expected, "But Got:", buf.String())
+	}
+}
+
+func TestSnapshotRevalidates(t *testing.T) {
+	tmp, err := ioutil.TempDir("", tempFilePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	savedDir, savedDelay, savedMirror := *dir, *delay, mirror
+	defer func() {
+		*dir, *delay, mirror = savedDir, savedDelay, savedMirror
+		snapshotRoot, previous, previousDir = "", nil, ""
+	}()
+
+	*delay = 0
+
+	full := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		full++
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("unchanged"))
+	}))
+	defer server.Close()
+
+	u := server.URL + "/page.txt"
+	started := time.Date(2026, 10, 19, 9, 30, 0, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		*dir = tmp
+		if err := startSnapshot(started.Add(time.Duration(i) * time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.MkdirAll(metaPath(""), 0777); err != nil {
+			t.Fatal(err)
+		}
+
+		mirror, err = openManifest(metaPath(manifestName))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := fetchToFile(u); err != nil {
+			t.Fatal(err)
+		}
+		mirror.close()
+	}
+
+	if full != 1 {
+		t.Error("Expected: 1 full download", "But Got:", full)
+	}
+
+	// the second snapshot still has the file and its entry
+	data, err := ioutil.ReadFile(localPath(u))
+	if err != nil || string(data) != "unchanged" {
+		t.Error("Expected: unchanged", "But Got:", string(data), err)
+	}
+
+	m, err := openManifest(metaPath(manifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.close()
+
+	if m.get(u) == nil {
+		t.Error("Expected: an entry for", u, "But Got: nil")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// newTransport builds the HTTP transport of the shared client
+// from the timeouts, proxy and TLS options
+func newTransport() (*http.Transport, error) {
+	dialer := &net.Dialer{
+		Timeout:   *connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: *insecure,
+	}
+
+	if *caCert != "" {
+		pool, err := loadCertPool(*caCert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	proxy := http.ProxyFromEnvironment
+
+	if *proxyURL != "" {
+		parsed, err := url.Parse(*proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("-proxy -> %v", err)
+		}
+
+		switch parsed.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("-proxy -> unsupported scheme %q", parsed.Scheme)
+		}
+
+		proxy = http.ProxyURL(parsed)
+	}
+
+	t := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   *tlsTimeout,
+		ResponseHeaderTimeout: *headerTimeout,
+		ExpectContinueTimeout: time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		// one idle connection per worker
+		MaxIdleConns:        *concurrency * 2,
+		MaxIdleConnsPerHost: *concurrency,
+		ForceAttemptHTTP2:   !*disableHTTP2,
+	}
+
+	if *disableHTTP2 {
+		// a non-nil empty map disables HTTP/2
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	return t, nil
+}
+
+var (
+	// errStalled is returned by idleBody when the body
+	// stops coming for longer than -read-timeout
+	errStalled = errors.New("response body stalled longer than -read-timeout")
+)
+
+// idleTimeoutTransport fails reads of response bodies
+// waiting longer than timeout for more data
+type idleTimeoutTransport struct {
+	http.RoundTripper
+	timeout time.Duration
+}
+
+// RoundTrip sends req, watching the body of its response
+func (t *idleTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = newIdleBody(resp.Body, t.timeout)
+
+	return resp, nil
+}
+
+// idleBody closes the body once a read waits longer than timeout,
+// only time spent inside Read counts, not between reads
+type idleBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+// newIdleBody watches the reads of body
+func newIdleBody(body io.ReadCloser, timeout time.Duration) *idleBody {
+	b := &idleBody{
+		ReadCloser: body,
+		timeout:    timeout,
+	}
+
+	// closing the body unblocks a pending read
+	b.timer = time.AfterFunc(timeout, func() {
+		body.Close()
+	})
+	b.timer.Stop()
+
+	return b
+}
+
+// Read reads from the body, failing if it stalled
+func (b *idleBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+
+	n, err := b.ReadCloser.Read(p)
+
+	// already fired
+	if !b.timer.Stop() {
+		return n, errStalled
+	}
+
+	return n, err
+}
+
+// Close stops watching and closes the body
+func (b *idleBody) Close() error {
+	b.timer.Stop()
+
+	return b.ReadCloser.Close()
+}
+
+// loadCertPool loads the system certificates
+// plus the PEM certificates in file p
+func loadCertPool(p string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("-ca-cert -> no PEM certificates found in %s", p)
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNewTransportCACert(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	f, err := ioutil.TempFile("", tempFilePrefix)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.Remove(f.Name())
+
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	f.Close()
+
+	defer func() { *caCert = "" }()
+
+	// unknown CA
+	transport, err := newTransport()
+	if err != nil {
+		t.Error("newTransport() ->", err)
+		return
+	}
+
+	if _, err := (&http.Client{Transport: transport}).Get(server.URL); err == nil {
+		t.Error("Expected unknown authority err, But Got: nil")
+	}
+
+	*caCert = f.Name()
+
+	transport, err = newTransport()
+	if err != nil {
+		t.Error("newTransport() ->", err)
+		return
+	}
+
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		t.Error("Expected trusted -ca-cert, But Got:", err)
+		return
+	}
+	resp.Body.Close()
+
+}
+
+func TestNewTransportProxy(t *testing.T) {
+	defer func() { *proxyURL = "" }()
+
+	proxies := map[string]bool{
+		"http://127.0.0.1:3128":   true,
+		"socks5://127.0.0.1:1080": true,
+		"ftp://127.0.0.1:21":      false,
+	}
+
+	for p, valid := range proxies {
+		*proxyURL = p
+
+		_, err := newTransport()
+		if valid && err != nil {
+			t.Error(p, "is valid, but got err", err)
+		}
+
+		if !valid && err == nil {
+			t.Error(p, "is invalid, but got no err")
+		}
+	}
+
+}
+
+func TestIdleTimeoutTransport(t *testing.T) {
+	stall := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+
+		if r.URL.Path == "/stalled" {
+			<-stall
+			return
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(" second"))
+	}))
+	defer server.Close()
+	defer close(stall)
+
+	c := &http.Client{
+		Transport: &idleTimeoutTransport{http.DefaultTransport, 200 * time.Millisecond},
+	}
+
+	resp, err := c.Get(server.URL + "/stalled")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := time.Now()
+	_, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if err != errStalled || time.Since(started) > 2*time.Second {
+		t.Error("Expected:", errStalled, "But Got:", err, time.Since(started))
+	}
+
+	// slow readers aren't stalled bodies
+	resp, err = c.Get(server.URL + "/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	buf := make([]byte, 5)
+	io.ReadFull(resp.Body, buf)
+	time.Sleep(300 * time.Millisecond)
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(buf)+string(data) != "first second" {
+		t.Error("Expected: first second", "But Got:", string(buf)+string(data), err)
+	}
+}
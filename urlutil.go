@@ -1,22 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"html"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"time"
 )
 
 var (
-	// reusable client
-	client = &http.Client{}
+	// reusable client, headers are scoped again on redirects
+	client = &http.Client{
+		CheckRedirect: scopeRedirect,
+	}
 )
 
 // buildRequest builds a HTTP request and sets a custom User Agent
@@ -28,6 +32,21 @@ func buildRequest(u, ua string) (*http.Request, error) {
 	}
 
 	req.Header.Set("User-Agent", ua)
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	setHeaders(req)
+
+	// conditional request for what we already have
+	if *update {
+		setConditional(req, mirror.get(u))
+	} else {
+		setValidators(req, previousEntry(u))
+	}
+
+	// the rest of an interrupted download,
+	// WARC captures must be complete responses
+	if archive == nil {
+		setResume(req, u)
+	}
 
 	return req, err
 
@@ -35,16 +54,34 @@ func buildRequest(u, ua string) (*http.Request, error) {
 
 // fetch fetches a HTTP resource after the delay
 func fetch(u string, delay time.Duration) (*http.Response, error) {
-	// delayed fetching
-	<-time.After(delay)
+	waitDelay(u, delay)
 
+	return fetchNow(u)
+}
+
+// waitDelay waits before fetching u, delay unless
+// its host overrides it
+func waitDelay(u string, delay time.Duration) {
+	<-time.After(hostDelay(u, delay))
+}
+
+// fetchNow fetches u without waiting
+func fetchNow(u string) (*http.Response, error) {
 	req, err := buildRequest(u, *userAgent)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return client.Do(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// the progress shows downloads as they go
+	countBody(resp)
+
+	return resp, nil
 }
 
 func getDir(u string) (string, error) {
@@ -194,37 +231,36 @@ func dirName(f string) (dir string) {
 
 }
 
-// saveFile save the resp body HTTP response to name file
-func saveFile(resp *http.Response, name string) error {
-	defer resp.Body.Close()
-
+// saveFile save the body r to name file
+func saveFile(r io.Reader, name string) error {
 	f, err := ioutil.TempFile("", tempFilePrefix)
 	if err != nil {
 		return err
 	}
-	_, err = io.Copy(f, resp.Body)
+
+	// hashed as written for the content store
+	h := sha256.New()
+
+	_, err = io.Copy(io.MultiWriter(f, h), r)
 	if err != nil {
 		defer func() {
 			// clean the mess
 			err := os.Remove(f.Name())
 			if err != nil {
-				log.Println(err)
+				logError(err)
 			}
 		}()
 
 		return err
 	}
 
-	dir := dirName(name)
-
-	err = os.MkdirAll(dir, 0777)
+	err = f.Close()
 	if err != nil {
+		os.Remove(f.Name())
 		return err
 	}
 
-	err = os.Rename(f.Name(), name)
-
-	return err
+	return placeFile(f.Name(), name, h.Sum(nil))
 
 }
 
@@ -252,6 +288,11 @@ func parseURL(u string) (string, error) {
 
 // filterDiscovered filters discovered URL according of
 func filterDiscovered(uri, content string) (filtered []string) {
+	// the links of the fetched page replace the recorded ones
+	if err := graph.reset(uri); err != nil {
+		logError(err)
+	}
+
 	links := discoverHREFURLs(content)
 
 	assets := discoverAssetsURLs(content)
@@ -271,6 +312,20 @@ func filterDiscovered(uri, content string) (filtered []string) {
 			continue
 		}
 
+		if err := graph.add(uri, u, edgeAsset); err != nil {
+			logError(err)
+		}
+
+		// queued once, however many pages use it
+		if events.discovered(u, uri) {
+			events.record(&crawlEvent{
+				Event: eventQueued,
+				URL:   u,
+				From:  uri,
+				Rule:  "asset",
+			})
+		}
+
 		filtered = append(filtered, u)
 
 	}
@@ -284,25 +339,55 @@ func filterDiscovered(uri, content string) (filtered []string) {
 			continue
 		}
 
+		// every link is an edge, even if we don't follow it
+		if err := graph.add(uri, u, edgeLink); err != nil {
+			logError(err)
+		}
+
+		ev := &crawlEvent{
+			Event: eventRejected,
+			URL:   u,
+			From:  uri,
+		}
+
 		// allowed URL?
-		allowed, err := mayFetchURL(u)
+		allowed, reason, err := filterURL(u)
+		ev.Rule = reason
+
 		if err != nil || !allowed {
+			if err != nil {
+				ev.Error = err.Error()
+			}
+			events.record(ev)
 			continue
 		}
 
 		// parent and ascend
 		if isAscending(u, pages) && !*ascend {
+			ev.Rule = "-ascend"
+			events.record(ev)
 			continue
 		}
 
-		// already downloaded
-		localFile := prettyName(u)
-		if _, err := os.Stat(localFile); err == nil {
-			continue
+		// already downloaded, unless we are updating
+		// or checking links
+		if !*update && !*checkLinks {
+			if _, err := os.Stat(localPath(u)); err == nil {
+				ev.Event = eventSkipped
+				ev.Rule = ruleExists
+				events.record(ev)
+				continue
+			}
 		}
 
 		u = strings.TrimSpace(u)
 
+		// queued once, however many pages link to it
+		if events.discovered(u, uri) {
+			ev.Event = eventQueued
+			events.record(ev)
+		}
+
 		filtered = append(filtered, u)
 
 	}
@@ -479,38 +564,50 @@ func isOfflineHost(host string) bool {
 	return false
 }
 
-// mayFetchURL checks whether URL is allowed to be fetched or not
-func mayFetchURL(u string) (bool, error) {
+// filterURL checks whether URL is allowed to be fetched or not,
+// and tells which filter or rule made the decision
+func filterURL(u string) (bool, string, error) {
 
 	parsed, err := url.Parse(u)
 
 	if err != nil {
-		return false, err
+		return false, "", err
 	}
 
 	if !*downloadURLsWithQueryString &&
 		strings.Contains(u, "?") {
-		return false, nil
+		return false, "-dl-query", nil
 	}
 
 	if skippableURL(u) {
-		return false, nil
+		return false, "-skipped-urls", nil
 	}
 
 	if skippableHost(parsed.Host) {
-		return false, nil
+		return false, "-skipped-hosts", nil
 	}
 
 	if !allowedURL(u) {
-		return false, nil
+		return false, "-only-urls", nil
 	}
 
 	if !allowedHost(parsed.Host) {
-		return false, nil
+		return false, "-only-hosts", nil
+	}
+
+	// rules of the host come first
+	if hc := hostOverride(parsed); hc != nil {
+		if r := matchRules(hc.rules, u, parsed); r != nil {
+			return r.allow, r.String(), nil
+		}
+	}
+
+	if r := matchRules(urlRules, u, parsed); r != nil {
+		return r.allow, r.String(), nil
 	}
 
 	// say yes
-	return true, nil
+	return true, "default", nil
 }
 
 // isParent checks whether "other" is parent to "uri"
@@ -533,37 +630,39 @@ func isParent(uri, other string) bool {
 }
 
 // mayFetchContent checks whether Content is allowed to be fetched or not
-func mayFetchContent(u string) (bool, error) {
+// using the response headers only, before the body is read
+func mayFetchContent(resp *http.Response) (bool, string) {
+	mt := mediaType(resp.Header)
 
-	parsed, err := url.Parse(u)
-
-	if err != nil {
-		return false, err
+	if p, ok := matchMIMEList(*rejectMIME, mt); ok {
+		return false, "-reject-mime " + p
 	}
 
-	if !*downloadURLsWithQueryString &&
-		strings.Contains(u, "?") {
-		return false, nil
+	if strings.TrimSpace(*acceptMIME) != "" {
+		if _, ok := matchMIMEList(*acceptMIME, mt); !ok {
+			return false, "-accept-mime"
+		}
 	}
 
-	if skippableURL(u) {
-		return false, nil
+	if !*downloadArchive && isArchive(resp.Header) {
+		return false, "-dl-archive"
 	}
 
-	if skippableHost(parsed.Host) {
-		return false, nil
+	if !*downloadMedia && isMedia(resp.Header) {
+		return false, "-dl-media"
 	}
 
-	if !allowedURL(u) {
-		return false, nil
+	size := resp.ContentLength
+	if size >= 0 {
+		size += rangeOffset(resp)
 	}
 
-	if !allowedHost(parsed.Host) {
-		return false, nil
+	if maxFileSize > 0 && size > int64(maxFileSize) {
+		return false, "-max-file-size"
 	}
 
 	// say yes
-	return true, nil
+	return true, ""
 }
 
 // skippableHost checks if Host may be skipped
@@ -672,56 +771,266 @@ func allowedURL(url string) bool {
 	return true
 }
 
-// fetchToFile fetch URL and save it to local file
-func fetchToFile(u string) error {
+// fetchToFile fetch URL and save it to local file,
+// returns the mirror entry of the saved or unchanged file,
+// or nil when the URL or its content was skipped.
+// The outcome is recorded to the events log
+func fetchToFile(u string) (e *mirrorEntry, err error) {
+	ev := &crawlEvent{
+		URL:  u,
+		From: events.referrer(u),
+	}
+	started := time.Now()
+	// the delays before requests aren't part of the duration
+	var waited time.Duration
+
+	defer func() {
+		ev.Duration = float64(time.Since(started)-waited) / float64(time.Millisecond)
+
+		switch {
+		case err != nil:
+			ev.Event = eventFailed
+			ev.Error = err.Error()
+		case ev.Event == "" && e != nil:
+			ev.Event = eventFetched
+		}
+
+		if e != nil {
+			ev.File = e.File
+			ev.Bytes = e.Size
+		}
+
+		events.record(ev)
+	}()
 
 	parsed, err := parseURL(u)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// check URL structure
 	// if it allowed to be fetched
-	willFetch, err := mayFetchURL(u)
+	willFetch, reason, err := filterURL(u)
 	if err != nil {
-		return fmt.Errorf("Err: isAllowedURL(%s) -> err -> %v",
+		return nil, fmt.Errorf("Err: isAllowedURL(%s) -> err -> %v",
 			u,
 			err,
 		)
 	}
 
 	if !willFetch {
-		return fmt.Errorf("Err: isAllowedURL(%s) -> NotAllowed",
-			u,
-		)
+		ev.Event = eventRejected
+		ev.Rule = reason
+		return nil, nil
+	}
+
+	for attempt := 0; ; attempt++ {
+		before := time.Now()
+		waitDelay(parsed, *delay)
+		waited += time.Since(before)
+
+		e, err := download(u, parsed, ev)
+
+		if err == nil || !*retry ||
+			attempt >= *retryCount || !isRetryable(err) {
+			return e, err
+		}
+
+		events.record(&crawlEvent{
+			Event:  eventRetry,
+			URL:    u,
+			Status: ev.Status,
+			Error:  err.Error(),
+		})
+	}
+}
+
+// statusError is a failed fetch because of the HTTP status
+type statusError struct {
+	url    string
+	code   int
+	status string
+}
+
+// Error formats the status error
+func (e *statusError) Error() string {
+	return fmt.Sprintf("Err: fetch(%s) -> %s", e.url, e.status)
+}
+
+// isRetryable checks whether fetching again may succeed,
+// network errors and server side failures are retried
+func isRetryable(err error) bool {
+	if err == errTooLarge {
+		return false
+	}
+
+	if e, ok := err.(*statusError); ok {
+		return e.code >= http.StatusInternalServerError ||
+			e.code == http.StatusTooManyRequests ||
+			e.code == http.StatusRequestedRangeNotSatisfiable
 	}
 
-	resp, err := fetch(parsed, *delay)
+	return true
+}
+
+// download fetches the parsed URL right away and saves it to its
+// local file, the response status and decisions are set on ev
+func download(u, parsed string, ev *crawlEvent) (*mirrorEntry, error) {
+	resp, err := fetchNow(parsed)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	defer resp.Body.Close()
 
-	// undesired archive or media
-	if !*downloadArchive && isArchive(resp.Request.Header) ||
-		!*downloadMedia && isMedia(resp.Request.Header) {
-		return nil
+	ev.Status = resp.StatusCode
+
+	// archive the raw response as it is read
+	capture := archive.capture(resp, events.referrer(u), time.Now())
+	defer func() {
+		if err := capture.finish(); err != nil {
+			logError(err)
+		}
+	}()
+
+	// share the bandwidth among workers
+	throttle(resp)
+
+	// unchanged since last run, keep our copy
+	if resp.StatusCode == http.StatusNotModified {
+		if e := mirror.get(parsed); e != nil {
+			ev.Event = eventUnchanged
+			return e, nil
+		}
+
+		// unchanged since the previous snapshot
+		if e := previousEntry(parsed); e != nil {
+			ev.Event = eventUnchanged
+			return reuseEntry(e)
+		}
+
+		return nil, fmt.Errorf("Err: fetch(%s) -> %s without a local copy",
+			u,
+			resp.Status,
+		)
+	}
+
+	// our partial download is of no use, start over next time
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		removePartial(parsed)
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, &statusError{
+			url:    u,
+			code:   resp.StatusCode,
+			status: resp.Status,
+		}
+	}
+
+	// undesired content, skip it before reading the body
+	if allowed, reason := mayFetchContent(resp); !allowed {
+		ev.Event = eventSkipped
+		ev.Rule = reason
+		return nil, nil
 	}
 
 	// cool, seems we gonna save it
 	// lets give it a cool name
-	name := prettyName(u)
+	name := prettyName(parsed)
+	file := localPath(parsed)
+	contentType := resp.Header.Get("Content-Type")
+
+	if isResumable(resp) {
+		// chunked or lying responses may still grow too large
+		limitBody(resp, rangeOffset(resp))
+
+		err = savePartial(resp, parsed, file)
+	} else {
+		err = saveDecoded(resp, file, &contentType)
+	}
 
-	err = saveFile(resp, name)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// pretty := prettyURL(u)
+	e := &mirrorEntry{
+		URL:          parsed,
+		File:         name,
+		ContentType:  contentType,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Fetched:      time.Now(),
+	}
+
+	if size, err := savedSize(file); err == nil {
+		e.Size = size
+	}
 
-	return nil
+	return e, mirror.put(e)
+}
+
+// saveDecoded decodes the response body and saves it to file,
+// HTML, CSS and JS are normalized, updating contentType
+func saveDecoded(resp *http.Response, file string, contentType *string) error {
+	// we store the resource, not its transfer encoding
+	err := decodeBody(resp)
+	if err != nil {
+		return fmt.Errorf("Err: decodeBody(%s) -> %v", resp.Request.URL, err)
+	}
+
+	// chunked, compressed or lying responses may still grow too large
+	limitBody(resp, 0)
+
+	var body io.Reader = resp.Body
+
+	// HTML, CSS and JS are processed as UTF-8
+	if isText(mediaType(resp.Header)) {
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+
+		data, *contentType, err = normalizeText(data, *contentType)
+		if err != nil {
+			return fmt.Errorf("Err: normalizeText(%s) -> %v", resp.Request.URL, err)
+		}
+
+		body = bytes.NewReader(data)
+	}
+
+	return saveFile(body, file)
+}
+
+// setConditional sets If-None-Match and If-Modified-Since
+// from the mirror entry, if its local file still exists
+func setConditional(req *http.Request, e *mirrorEntry) {
+	if e == nil {
+		return
+	}
+
+	if _, err := os.Stat(filepath.Join(*dir, e.File)); err != nil {
+		return
+	}
+
+	setValidators(req, e)
+}
+
+// setValidators sets If-None-Match and If-Modified-Since
+// from the mirror entry
+func setValidators(req *http.Request, e *mirrorEntry) {
+	if e == nil {
+		return
+	}
+
+	if e.ETag != "" {
+		req.Header.Set("If-None-Match", e.ETag)
+	}
+
+	if e.LastModified != "" {
+		req.Header.Set("If-Modified-Since", e.LastModified)
+	}
 }
 
 // parseHosts parses data for hosts
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
 )
 
@@ -210,3 +212,28 @@ func TestIsParent(t *testing.T) {
 	}
 
 }
+
+func TestFilterDiscoveredQueuedOnce(t *testing.T) {
+	savedEvents, savedPages, savedDir := events, pages, *dir
+	defer func() {
+		events, pages, *dir = savedEvents, savedPages, savedDir
+	}()
+
+	events = newEventLog(ioutil.Discard)
+	pages = []string{"https://example.com/"}
+	*dir = os.TempDir()
+
+	// the nav of every page
+	nav := `<a href="/about">About</a><img src="/logo.png">`
+
+	for _, page := range []string{"https://example.com/", "https://example.com/faqs", "https://example.com/blog"} {
+		if filtered := filterDiscovered(page, nav); len(filtered) != 2 {
+			t.Error("Expected: 2", "But Got:", filtered)
+		}
+	}
+
+	counts, _ := events.snapshot()
+	if counts[eventQueued] != 2 {
+		t.Error("Expected: 2 queued", "But Got:", counts[eventQueued])
+	}
+}
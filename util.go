@@ -2,24 +2,21 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os"
+	"strings"
 )
 
-// exit writes error to stderr and exit
-func exit(code int, s ...interface{}) {
-	fmt.Fprintln(os.Stderr, s...)
+// fatal records the error then exits
+func fatal(code int, s ...interface{}) {
+	logError(s...)
+	events.close()
 	os.Exit(code)
 }
 
-// exitf writes formated error msgs to stderr and exit
-func exitf(code int, format string, s ...interface{}) {
-	fmt.Fprintf(os.Stderr, format, s...)
-	os.Exit(code)
-}
-
-// logf logs error and exit
-func logf(code int, format string, s ...interface{}) {
-	log.Printf(format, s...)
-	os.Exit(code)
+// logError records an error not tied to an URL
+func logError(s ...interface{}) {
+	events.record(&crawlEvent{
+		Event: eventError,
+		Error: strings.TrimSpace(fmt.Sprintln(s...)),
+	})
 }
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	warcVersion = "WARC/1.1"
+
+	warcProfileNotModified = "http://netpreserve.org/warc/1.1/revisit/server-not-modified"
+	warcProfileIdentical   = "http://netpreserve.org/warc/1.1/revisit/identical-payload-digest"
+
+	// error pages are archived up to this size
+	warcMaxErrorBody = 1 << 20
+
+	defaultWARCMaxSize = 1 << 30
+)
+
+// warcField is a WARC named field, in the order written
+type warcField struct {
+	name, value string
+}
+
+// warcCapture is the first capture of a payload,
+// identical payloads later on are archived as revisits
+type warcCapture struct {
+	uri, date string
+}
+
+// warcWriter writes gzip-compressed WARC records to FILE,
+// rolling over to FILE-00001.warc.gz and so on once maxSize
+// is reached, with a CDXJ index of all of them at close
+type warcWriter struct {
+	mu sync.Mutex
+
+	base    string
+	maxSize int64
+	serial  int
+
+	f    *os.File
+	name string
+	size int64
+
+	digests map[string]warcCapture
+	index   []string
+}
+
+var (
+	// archive is nil unless -warc is set
+	archive *warcWriter
+)
+
+// newWARCWriter creates the first WARC file at base
+func newWARCWriter(base string, maxSize int64) (*warcWriter, error) {
+	w := &warcWriter{
+		base:    base,
+		maxSize: maxSize,
+		digests: map[string]warcCapture{},
+	}
+
+	err := w.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// warcFileName gets the name of the serial-th WARC file of base
+func warcFileName(base string, serial int) string {
+	if serial == 0 {
+		return base
+	}
+
+	ext := ""
+	for _, e := range []string{".warc.gz", ".warc", ".gz"} {
+		if strings.HasSuffix(base, e) {
+			ext = e
+			break
+		}
+	}
+
+	return fmt.Sprintf("%s-%05d%s", strings.TrimSuffix(base, ext), serial, ext)
+}
+
+// cdxjPath gets the CDXJ index path of the WARC base
+func cdxjPath(base string) string {
+	for _, e := range []string{".gz", ".warc"} {
+		base = strings.TrimSuffix(base, e)
+	}
+
+	return base + ".cdxj"
+}
+
+// open opens the current WARC file and writes its warcinfo record
+func (w *warcWriter) open() error {
+	w.name = warcFileName(w.base, w.serial)
+
+	f, err := os.OpenFile(w.name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	w.f = f
+	w.size = 0
+
+	info := []byte(fmt.Sprintf("software: loca/%v\r\n"+
+		"format: WARC File Format 1.1\r\n"+
+		"conformsTo: http://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/\r\n",
+		version,
+	))
+
+	_, _, err = w.writeRecord([]warcField{
+		{"WARC-Type", "warcinfo"},
+		{"WARC-Record-ID", newRecordID()},
+		{"WARC-Date", warcDate(time.Now())},
+		{"WARC-Filename", filepath.Base(w.name)},
+		{"Content-Type", "application/warc-fields"},
+		{"WARC-Block-Digest", sha1Digest(info)},
+	}, bytes.NewReader(info), int64(len(info)))
+
+	return err
+}
+
+// countingWriter counts the bytes written to the WARC file
+type countingWriter struct {
+	w *warcWriter
+}
+
+// Write writes to the WARC file
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.f.Write(p)
+	c.w.size += int64(n)
+	return n, err
+}
+
+// writeRecord writes a record as its own gzip member,
+// returning its offset and compressed length
+func (w *warcWriter) writeRecord(fields []warcField, block io.Reader, length int64) (int64, int64, error) {
+	offset := w.size
+
+	gz := gzip.NewWriter(countingWriter{w})
+
+	head := &bytes.Buffer{}
+	head.WriteString(warcVersion + "\r\n")
+	for _, f := range fields {
+		head.WriteString(f.name + ": " + f.value + "\r\n")
+	}
+	head.WriteString("Content-Length: " + strconv.FormatInt(length, 10) + "\r\n\r\n")
+
+	if _, err := gz.Write(head.Bytes()); err != nil {
+		return 0, 0, err
+	}
+
+	if _, err := io.Copy(gz, block); err != nil {
+		return 0, 0, err
+	}
+
+	if _, err := io.WriteString(gz, "\r\n\r\n"); err != nil {
+		return 0, 0, err
+	}
+
+	if err := gz.Close(); err != nil {
+		return 0, 0, err
+	}
+
+	return offset, w.size - offset, nil
+}
+
+// rollover starts the next WARC file once the current one is full
+func (w *warcWriter) rollover() error {
+	if w.maxSize <= 0 || w.size < w.maxSize {
+		return nil
+	}
+
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+
+	w.serial++
+
+	return w.open()
+}
+
+// addIndex adds a CDXJ line of a response or revisit record
+func (w *warcWriter) addIndex(u string, fetched time.Time, fields map[string]string) {
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return
+	}
+
+	w.index = append(w.index, surt(u)+" "+fetched.UTC().Format("20060102150405")+" "+string(data))
+}
+
+// close closes the WARC file and writes the sorted CDXJ index
+func (w *warcWriter) close() error {
+	if w == nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.f.Close()
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(w.index)
+
+	data := strings.Join(w.index, "\n")
+	if data != "" {
+		data += "\n"
+	}
+
+	return ioutil.WriteFile(cdxjPath(w.base), []byte(data), 0666)
+}
+
+// responseCapture spools a raw response body as it is read,
+// so it can be archived once complete
+type responseCapture struct {
+	w    *warcWriter
+	resp *http.Response
+	from string
+
+	body    io.ReadCloser
+	spool   *os.File
+	size    int64
+	payload hash.Hash
+	block   hash.Hash
+	head    []byte
+	started time.Time
+
+	complete bool
+	err      error
+}
+
+// capture starts archiving resp, its body must be read
+// through resp.Body before finish is called
+func (w *warcWriter) capture(resp *http.Response, from string, started time.Time) *responseCapture {
+	if w == nil {
+		return nil
+	}
+
+	c := &responseCapture{
+		w:       w,
+		resp:    resp,
+		from:    from,
+		body:    resp.Body,
+		payload: sha1.New(),
+		block:   sha1.New(),
+		head:    httpResponseHead(resp),
+		started: started,
+	}
+
+	c.block.Write(c.head)
+
+	c.spool, c.err = ioutil.TempFile("", tempFilePrefix+"warc-")
+
+	resp.Body = c
+
+	return c
+}
+
+// Read reads the raw body, copying it to the spool
+func (c *responseCapture) Read(p []byte) (int, error) {
+	n, err := c.body.Read(p)
+
+	if n > 0 && c.err == nil {
+		_, c.err = c.spool.Write(p[:n])
+		c.payload.Write(p[:n])
+		c.block.Write(p[:n])
+		c.size += int64(n)
+	}
+
+	if err == io.EOF {
+		c.complete = true
+	}
+
+	return n, err
+}
+
+// Close closes the raw body
+func (c *responseCapture) Close() error {
+	return c.body.Close()
+}
+
+// finish archives the capture: request, response and metadata
+// records, or a revisit when not modified or already archived.
+// Skipped responses aren't archived, error pages and bodies left
+// unread by decoders are read here
+func (c *responseCapture) finish() error {
+	if c == nil {
+		return nil
+	}
+
+	if c.spool != nil {
+		defer os.Remove(c.spool.Name())
+		defer c.spool.Close()
+	}
+
+	notModified := c.resp.StatusCode == http.StatusNotModified
+
+	if !c.complete && (c.size > 0 || c.resp.ContentLength == 0 ||
+		c.resp.StatusCode >= http.StatusBadRequest) {
+		io.Copy(ioutil.Discard, io.LimitReader(c, warcMaxErrorBody))
+	}
+
+	if !c.complete && !notModified {
+		return nil
+	}
+
+	if c.err != nil {
+		return fmt.Errorf("Err: capture(%s) -> %v", c.resp.Request.URL, c.err)
+	}
+
+	w := c.w
+	u := c.resp.Request.URL.String()
+	date := warcDate(c.started)
+	digest := "sha1:" + base32.StdEncoding.EncodeToString(c.payload.Sum(nil))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.rollover(); err != nil {
+		return err
+	}
+
+	request := httpRequestHead(c.resp.Request)
+	requestID := newRecordID()
+	responseID := newRecordID()
+
+	_, _, err := w.writeRecord([]warcField{
+		{"WARC-Type", "request"},
+		{"WARC-Record-ID", requestID},
+		{"WARC-Date", date},
+		{"WARC-Target-URI", u},
+		{"WARC-Concurrent-To", responseID},
+		{"Content-Type", "application/http;msgtype=request"},
+		{"WARC-Block-Digest", sha1Digest(request)},
+	}, bytes.NewReader(request), int64(len(request)))
+	if err != nil {
+		return err
+	}
+
+	index := map[string]string{
+		"url":      u,
+		"status":   strconv.Itoa(c.resp.StatusCode),
+		"filename": filepath.Base(w.name),
+	}
+
+	first, seen := w.digests[digest]
+
+	var offset, length int64
+
+	switch {
+	case notModified:
+		offset, length, err = w.writeRecord([]warcField{
+			{"WARC-Type", "revisit"},
+			{"WARC-Record-ID", responseID},
+			{"WARC-Date", date},
+			{"WARC-Target-URI", u},
+			{"WARC-Profile", warcProfileNotModified},
+			{"Content-Type", "application/http;msgtype=response"},
+			{"WARC-Block-Digest", sha1Digest(c.head)},
+		}, bytes.NewReader(c.head), int64(len(c.head)))
+
+		index["mime"] = "warc/revisit"
+
+	case seen && c.size > 0:
+		offset, length, err = w.writeRecord([]warcField{
+			{"WARC-Type", "revisit"},
+			{"WARC-Record-ID", responseID},
+			{"WARC-Date", date},
+			{"WARC-Target-URI", u},
+			{"WARC-Profile", warcProfileIdentical},
+			{"WARC-Refers-To-Target-URI", first.uri},
+			{"WARC-Refers-To-Date", first.date},
+			{"WARC-Payload-Digest", digest},
+			{"Content-Type", "application/http;msgtype=response"},
+			{"WARC-Block-Digest", sha1Digest(c.head)},
+		}, bytes.NewReader(c.head), int64(len(c.head)))
+
+		index["mime"] = "warc/revisit"
+		index["digest"] = digest
+
+	default:
+		if _, err := c.spool.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		offset, length, err = w.writeRecord([]warcField{
+			{"WARC-Type", "response"},
+			{"WARC-Record-ID", responseID},
+			{"WARC-Date", date},
+			{"WARC-Target-URI", u},
+			{"Content-Type", "application/http;msgtype=response"},
+			{"WARC-Payload-Digest", digest},
+			{"WARC-Block-Digest", "sha1:" + base32.StdEncoding.EncodeToString(c.block.Sum(nil))},
+		}, io.MultiReader(bytes.NewReader(c.head), c.spool), int64(len(c.head))+c.size)
+
+		index["mime"] = mediaType(c.resp.Header)
+		index["digest"] = digest
+
+		if c.size > 0 && !seen {
+			w.digests[digest] = warcCapture{uri: u, date: date}
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	index["offset"] = strconv.FormatInt(offset, 10)
+	index["length"] = strconv.FormatInt(length, 10)
+	w.addIndex(u, c.started, index)
+
+	metadata := []byte(fmt.Sprintf("fetchTimeMs: %d\r\n",
+		time.Since(c.started)/time.Millisecond,
+	))
+	if c.from != "" {
+		metadata = append([]byte("via: "+c.from+"\r\n"), metadata...)
+	}
+
+	_, _, err = w.writeRecord([]warcField{
+		{"WARC-Type", "metadata"},
+		{"WARC-Record-ID", newRecordID()},
+		{"WARC-Date", date},
+		{"WARC-Target-URI", u},
+		{"WARC-Concurrent-To", responseID},
+		{"Content-Type", "application/warc-fields"},
+		{"WARC-Block-Digest", sha1Digest(metadata)},
+	}, bytes.NewReader(metadata), int64(len(metadata)))
+
+	return err
+}
+
+// httpResponseHead formats the status line and headers of resp,
+// the body is archived without its transfer encoding
+func httpResponseHead(resp *http.Response) []byte {
+	b := &bytes.Buffer{}
+
+	proto := resp.Proto
+	if resp.ProtoMajor != 1 {
+		// replay tools speak HTTP/1.x
+		proto = "HTTP/1.1"
+	}
+
+	fmt.Fprintf(b, "%s %s\r\n", proto, resp.Status)
+	resp.Header.Write(b)
+	b.WriteString("\r\n")
+
+	return b.Bytes()
+}
+
+// httpRequestHead formats the request line and headers of req,
+// credentials are not archived
+func httpRequestHead(req *http.Request) []byte {
+	b := &bytes.Buffer{}
+
+	fmt.Fprintf(b, "%s %s HTTP/1.1\r\n", req.Method, req.URL.RequestURI())
+	fmt.Fprintf(b, "Host: %s\r\n", req.URL.Host)
+
+	header := http.Header{}
+	for name, values := range req.Header {
+		if !isCredentialHeader(name) {
+			header[name] = values
+		}
+	}
+
+	header.Write(b)
+	b.WriteString("\r\n")
+
+	return b.Bytes()
+}
+
+// warcDate formats t as a WARC-Date
+func warcDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05Z")
+}
+
+// sha1Digest gets the WARC digest of data
+func sha1Digest(data []byte) string {
+	sum := sha1.Sum(data)
+
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+// newRecordID generates a random UUID record ID
+func newRecordID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// surt gets the Sort-friendly URI Reordering Transform of u,
+// used as the CDXJ key
+func surt(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+
+	host := strings.ToLower(parsed.Hostname())
+	host = strings.TrimPrefix(host, "www.")
+
+	key := host
+
+	// IP addresses aren't reversed
+	if net.ParseIP(host) == nil {
+		labels := strings.Split(host, ".")
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+
+		key = strings.Join(labels, ",")
+	}
+
+	if port := parsed.Port(); port != "" &&
+		!(parsed.Scheme == "http" && port == "80") &&
+		!(parsed.Scheme == "https" && port == "443") {
+		key += ":" + port
+	}
+
+	p := parsed.EscapedPath()
+	if p == "" {
+		p = "/"
+	}
+
+	key += ")" + strings.ToLower(p)
+
+	if parsed.RawQuery != "" {
+		params := strings.Split(parsed.RawQuery, "&")
+		sort.Strings(params)
+		key += "?" + strings.ToLower(strings.Join(params, "&"))
+	}
+
+	return key
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSURT(t *testing.T) {
+	tests := map[string]string{
+		"https://www.Example.com/About?b=2&a=1": "com,example)/about?a=1&b=2",
+		"http://example.com":                    "com,example)/",
+		"http://example.com:8080/x":             "com,example:8080)/x",
+		"https://docs.example.com:443/":         "com,example,docs)/",
+	}
+
+	for u, expected := range tests {
+		if got := surt(u); got != expected {
+			t.Error("Expected:", expected, "But Got:", got)
+		}
+	}
+}
+
+func TestWARCFileName(t *testing.T) {
+	tests := map[string]string{
+		"crawl.warc.gz": "crawl-00002.warc.gz",
+		"crawl.warc":    "crawl-00002.warc",
+		"crawl":         "crawl-00002",
+	}
+
+	for base, expected := range tests {
+		if got := warcFileName(base, 2); got != expected {
+			t.Error("Expected:", expected, "But Got:", got)
+		}
+	}
+
+	if got := cdxjPath("out/crawl.warc.gz"); got != "out/crawl.cdxj" {
+		t.Error("Expected: out/crawl.cdxj", "But Got:", got)
+	}
+}
+
+func TestWARCWriter(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cached":
+			w.WriteHeader(http.StatusNotModified)
+		case "/missing":
+			http.NotFound(w, r)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<p>same payload</p>"))
+		}
+	}))
+	defer srv.Close()
+
+	tmp, err := ioutil.TempDir("", "loca-warc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	base := filepath.Join(tmp, "crawl.warc.gz")
+
+	w, err := newWARCWriter(base, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"/a", "/b", "/cached", "/missing"} {
+		req, _ := http.NewRequest("GET", srv.URL+p, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := w.capture(resp, srv.URL+"/", time.Now())
+
+		if resp.StatusCode == http.StatusOK {
+			ioutil.ReadAll(resp.Body)
+		}
+
+		if err := c.finish(); err != nil {
+			t.Error(err)
+		}
+
+		resp.Body.Close()
+	}
+
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := string(data)
+
+	counts := map[string]int{
+		"WARC-Type: warcinfo":       1,
+		"WARC-Type: request":        4,
+		"WARC-Type: response":       2,
+		"WARC-Type: revisit":        2,
+		"WARC-Type: metadata":       4,
+		warcProfileIdentical:        1,
+		warcProfileNotModified:      1,
+		"HTTP/1.1 404 Not Found":    1,
+		"<p>same payload</p>":       1,
+		"via: " + srv.URL + "/\r\n": 4,
+		"Bearer secret":             0,
+	}
+
+	for k, expected := range counts {
+		if got := strings.Count(s, k); got != expected {
+			t.Error("Expected:", expected, k, "But Got:", got)
+		}
+	}
+
+	index, err := ioutil.ReadFile(cdxjPath(base))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(index)), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "127.0.0.1:") ||
+		!strings.Contains(string(index), `"mime":"warc/revisit"`) {
+		t.Error("Unexpected CDXJ:", string(index))
+	}
+}
+
+func TestWARCRollover(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "loca-warc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	base := filepath.Join(tmp, "crawl.warc.gz")
+
+	// the warcinfo record fills the first file already
+	w, err := newWARCWriter(base, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.mu.Lock()
+	err = w.rollover()
+	w.mu.Unlock()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.close()
+
+	if _, err := os.Stat(warcFileName(base, 1)); err != nil {
+		t.Error("Expected a second WARC file, But Got:", err)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/cascadia"
+	html5 "golang.org/x/net/html"
+)
+
+const (
+	watchName = "watch.json"
+
+	defaultWatchEvery = time.Hour
+	webhookTimeout    = 30 * time.Second
+)
+
+var (
+	// webhookClient posts to -webhook, apart from client
+	// so the cookies and credentials of the watched
+	// pages are not sent to the webhook host
+	webhookClient = &http.Client{Timeout: webhookTimeout}
+)
+
+// watchCapture is the text of a watched page when last checked
+type watchCapture struct {
+	Selector string    `json:"selector,omitempty"`
+	Lines    []string  `json:"lines"`
+	Checked  time.Time `json:"checked"`
+}
+
+// watchChange is the JSON payload POSTed to -webhook
+// when a watched page changes
+type watchChange struct {
+	URL      string    `json:"url"`
+	Selector string    `json:"selector,omitempty"`
+	Checked  time.Time `json:"checked"`
+	Previous time.Time `json:"previous_checked"`
+	Added    []string  `json:"added"`
+	Removed  []string  `json:"removed"`
+	Diff     string    `json:"diff"`
+}
+
+// loadWatchState reads the captures at p, by URL
+func loadWatchState(p string) (map[string]*watchCapture, error) {
+	state := map[string]*watchCapture{}
+
+	data, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return state, json.Unmarshal(data, &state)
+}
+
+// saveWatchState writes the captures to p
+func saveWatchState(p string, state map[string]*watchCapture) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), 0777)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(p, data, 0666)
+}
+
+// watchedLines fetches u and extracts the lines of its text,
+// only of the region matching selector unless it's empty
+func watchedLines(u string, selector cascadia.Selector) ([]string, error) {
+	page, err := fetchAsset(u, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	s, _, _ := decodeText(page.data, page.contentType)
+
+	if selector == nil {
+		_, lines, err := extractLines(s)
+		return lines, err
+	}
+
+	doc, err := html5.Parse(strings.NewReader(s))
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := selector.MatchAll(doc)
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("Err: -selector matched nothing in %s", u)
+	}
+
+	var lines []string
+
+	for _, n := range nodes {
+		buf := &bytes.Buffer{}
+		if err := html5.Render(buf, n); err != nil {
+			return nil, err
+		}
+
+		_, region, err := extractLines(buf.String())
+		if err != nil {
+			return nil, err
+		}
+
+		lines = append(lines, region...)
+	}
+
+	return lines, nil
+}
+
+// postChange POSTs the change to the webhook
+func postChange(webhook string, change *watchChange) error {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, webhook, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", *userAgent)
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("Err: webhook %s answered %s", webhook, resp.Status)
+	}
+
+	return nil
+}
+
+// checkWatched re-fetches the pages and compares them with their
+// last capture in the state file p, the first capture of a page
+// is only recorded, changes are POSTed to webhook if any,
+// until the webhook accepts them
+func checkWatched(pages []string, selector, webhook, p string) ([]*watchChange, error) {
+	var sel cascadia.Selector
+
+	if selector != "" {
+		var err error
+
+		sel, err = cascadia.Compile(selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -selector %q: %v", selector, err)
+		}
+	}
+
+	state, err := loadWatchState(p)
+	if err != nil {
+		return nil, fmt.Errorf("loadWatchState()-> %v", err)
+	}
+
+	var changes []*watchChange
+
+	for _, u := range pages {
+		checked := time.Now()
+
+		lines, err := watchedLines(u, sel)
+		if err != nil {
+			events.record(&crawlEvent{
+				Event: eventFailed,
+				URL:   u,
+				Error: err.Error(),
+			})
+			continue
+		}
+
+		last, ok := state[u]
+		state[u] = &watchCapture{
+			Selector: selector,
+			Lines:    lines,
+			Checked:  checked,
+		}
+
+		// a new page or region to compare with next time
+		if !ok || last.Selector != selector {
+			continue
+		}
+
+		if strings.Join(last.Lines, "\n") == strings.Join(lines, "\n") {
+			continue
+		}
+
+		change := &watchChange{
+			URL:      u,
+			Selector: selector,
+			Checked:  checked,
+			Previous: last.Checked,
+		}
+
+		ops := diffLines(last.Lines, lines)
+
+		for _, op := range ops {
+			switch op.kind {
+			case '+':
+				change.Added = append(change.Added, op.line)
+			case '-':
+				change.Removed = append(change.Removed, op.line)
+			}
+		}
+
+		buf := &bytes.Buffer{}
+		writeUnifiedDiff(buf,
+			last.Checked.UTC().Format(time.RFC3339),
+			checked.UTC().Format(time.RFC3339),
+			ops,
+		)
+		change.Diff = buf.String()
+
+		changes = append(changes, change)
+
+		if webhook == "" {
+			continue
+		}
+
+		if err := postChange(webhook, change); err != nil {
+			events.record(&crawlEvent{
+				Event: eventFailed,
+				URL:   webhook,
+				From:  u,
+				Error: err.Error(),
+			})
+
+			// compare with the last capture again next time,
+			// so the change is POSTed again
+			state[u] = last
+		}
+	}
+
+	return changes, saveWatchState(p, state)
+}
+
+// commandLineFlag sets its flag of flag.CommandLine, so the
+// options of a live crawl are given to a subcommand's flags
+type commandLineFlag struct {
+	f *flag.Flag
+}
+
+// String gets the value of the flag
+func (c commandLineFlag) String() string {
+	if c.f == nil {
+		return ""
+	}
+
+	return c.f.Value.String()
+}
+
+// Set sets the flag as if given on the command line
+func (c commandLineFlag) Set(v string) error {
+	return flag.Set(c.f.Name, v)
+}
+
+// IsBoolFlag lets boolean flags be given without a value
+func (c commandLineFlag) IsBoolFlag() bool {
+	b, ok := c.f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// runWatch runs `loca watch [options] URL...`, checking the pages
+// for changes every -every, or -once
+func runWatch(args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	every := fs.Duration("every", defaultWatchEvery, "How often to re-fetch the pages")
+	selector := fs.String("selector", "", "Compare only the text of the regions matching this CSS selector")
+	once := fs.Bool("once", false, "Check the pages once and exit, like from cron")
+	webhook := fs.String("webhook", "", "POST a JSON payload to this URL when a watched page changes")
+
+	flag.VisitAll(func(f *flag.Flag) {
+		fs.Var(commandLineFlag{f}, f.Name, f.Usage)
+	})
+
+	fs.Parse(args)
+
+	// watched pages are not mirrored, no hosts to rewrite
+	*offlineDisabled = true
+
+	err := parseOptions(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	pages, err = getStartPages()
+	if err != nil {
+		return err
+	}
+
+	// -basic-auth and the like are for the watched pages hosts
+	scopeCredentials(pages)
+
+	for {
+		changes, err := checkWatched(pages, *selector, *webhook, metaPath(watchName))
+		if err != nil {
+			return err
+		}
+
+		for _, c := range changes {
+			fmt.Printf("changed %s\n%s", c.URL, c.Diff)
+		}
+
+		if *once {
+			return nil
+		}
+
+		time.Sleep(*every)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCheckWatched(t *testing.T) {
+	mu := sync.Mutex{}
+	price := "5"
+	ad := "ad 1"
+
+	page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s"})
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<div class="ad">` + ad + `</div><table id="pricing">` +
+			`<tr><td>Basic</td><td>` + price + ` dollars</td></tr></table>`))
+	}))
+	defer page.Close()
+
+	var payloads []*watchChange
+	down := true
+
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		// same host as page, but the webhook isn't watched
+		if r.Header.Get("Cookie") != "" {
+			t.Error("Expected: no cookies sent to the webhook", "But Got:", r.Header.Get("Cookie"))
+		}
+
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Error("Expected: POST application/json", "But Got:", r.Method, r.Header.Get("Content-Type"))
+		}
+
+		change := &watchChange{}
+		if err := json.NewDecoder(r.Body).Decode(change); err != nil {
+			t.Error(err)
+		}
+
+		payloads = append(payloads, change)
+	}))
+	defer webhook.Close()
+
+	tmp, err := ioutil.TempDir("", "loca-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	jar, err := newCookieStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	savedDelay, savedJar := *delay, client.Jar
+	*delay, client.Jar = 0, jar
+	defer func() {
+		*delay, client.Jar = savedDelay, savedJar
+	}()
+
+	state := filepath.Join(tmp, watchName)
+	pages := []string{page.URL + "/pricing"}
+
+	check := func() []*watchChange {
+		changes, err := checkWatched(pages, "#pricing", webhook.URL, state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return changes
+	}
+
+	// the first capture is only recorded
+	if changes := check(); len(changes) != 0 {
+		t.Error("Expected: no changes", "But Got:", changes)
+	}
+
+	// outside of the selected region
+	mu.Lock()
+	ad = "ad 2"
+	mu.Unlock()
+
+	if changes := check(); len(changes) != 0 {
+		t.Error("Expected: no changes", "But Got:", changes)
+	}
+
+	mu.Lock()
+	price = "7"
+	mu.Unlock()
+
+	// the webhook fails, the change is kept for next time
+	if changes := check(); len(changes) != 1 {
+		t.Fatal("Expected: 1", "But Got:", len(changes))
+	}
+
+	down = false
+
+	changes := check()
+	if len(changes) != 1 {
+		t.Fatal("Expected: 1", "But Got:", len(changes))
+	}
+
+	if len(payloads) != 1 {
+		t.Fatal("Expected: 1 payload", "But Got:", len(payloads))
+	}
+
+	got := payloads[0]
+
+	if got.URL != pages[0] || got.Selector != "#pricing" {
+		t.Error("Expected:", pages[0], "#pricing", "But Got:", got.URL, got.Selector)
+	}
+
+	if strings.Join(got.Removed, "|") != "5 dollars" {
+		t.Error("Expected: 5 dollars", "But Got:", got.Removed)
+	}
+
+	if strings.Join(got.Added, "|") != "7 dollars" {
+		t.Error("Expected: 7 dollars", "But Got:", got.Added)
+	}
+
+	if !strings.Contains(got.Diff, " Basic\n-5 dollars\n+7 dollars") {
+		t.Error("Expected: the price change after Basic in", got.Diff)
+	}
+
+	// POSTed once it's accepted
+	if changes := check(); len(changes) != 0 {
+		t.Error("Expected: no changes", "But Got:", changes)
+	}
+}
+
+func TestRunWatchOnce(t *testing.T) {
+	page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "ops" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<p id="status">up</p>`))
+	}))
+	defer page.Close()
+
+	tmp, err := ioutil.TempDir("", "loca-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// watched pages are not rewritten, the list is never fetched
+	list := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Expected: no offline list fetch", "But Got:", r.URL)
+	}))
+	defer list.Close()
+
+	savedDir, savedDelay, savedOffline, savedAuth := *dir, *delay, *offlineDisabled, *basicAuth
+	savedList := *offlineHosts
+	defer func() {
+		*dir, *delay, *offlineDisabled, *basicAuth = savedDir, savedDelay, savedOffline, savedAuth
+		*offlineHosts = savedList
+		credentialHeaders, credentialHosts = http.Header{}, map[string]bool{}
+		flag.CommandLine.Parse(nil)
+	}()
+
+	err = runWatch([]string{
+		"-once",
+		"-selector", "#status",
+		"-dir", tmp,
+		"-delay", "0",
+		"-offline-list", list.URL + "/hosts",
+		"-basic-auth", "ops:secret",
+		page.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the crawl flags are set as given on the command line
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	if !given["delay"] || given["once"] {
+		t.Error("Expected: delay given, once unknown", "But Got:", given)
+	}
+
+	state, err := loadWatchState(filepath.Join(tmp, metaDir, watchName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, ok := state[page.URL]
+	if !ok || c.Selector != "#status" || strings.Join(c.Lines, "|") != "up" {
+		t.Error("Expected: up captured", "But Got:", state)
+	}
+}